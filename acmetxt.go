@@ -13,11 +13,17 @@ type ACMETxt struct {
 	Username uuid.UUID
 	Password string
 	ACMETxtPost
-	AllowFrom cidrslice
-	Fulldomain string `json:"fulldomain"`
-	DomainName string `json:"domain_name"`
-	CreatedAt int64 `json:"created_at"`
-	UpdatedAt int64 `json:"updated_at"`
+	AllowFrom  cidrslice
+	Fulldomain string            `json:"fulldomain"`
+	DomainName string            `json:"domain_name"`
+	CreatedAt  int64             `json:"created_at"`
+	UpdatedAt  int64             `json:"updated_at"`
+	TXTSlots   int               `json:"txt_slots"`
+	RegToken   string            `json:"reg_token"`
+	TenantID   string            `json:"tenant_id"`
+	Labels     map[string]string `json:"labels"`
+	Note       string            `json:"note"`
+	Owner      string            `json:"owner"`
 }
 
 // ACMETxtPost holds the DNS part of the ACMETxt struct
@@ -79,21 +85,6 @@ func (a ACMETxt) allowedFrom(ip string) bool {
 	return false
 }
 
-// Go through list (most likely from headers) to check for the IP.
-// Reason for this is that some setups use reverse proxy in front of acme-dns
-func (a ACMETxt) allowedFromList(ips []string) bool {
-	if len(ips) == 0 {
-		// If no IP provided, check if no whitelist present (everyone has access)
-		return a.allowedFrom("")
-	}
-	for _, v := range ips {
-		if a.allowedFrom(v) {
-			return true
-		}
-	}
-	return false
-}
-
 func newACMETxt() ACMETxt {
 	var a = ACMETxt{}
 	password := generatePassword(40)
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
@@ -23,19 +27,51 @@ func webRegisterPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	var regStatus int
 	var reg []byte
 	var err error
-	
+
+	// Administrators register records for their tenant
+	actor := Actor{IP: getClientIP(r)}
+	if r.Header.Get("Authorization") != "" {
+		actor, err = getAdminFromRequest(r)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Admin authentication failed")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write(jsonError("unauthorized"))
+			return
+		}
+	}
+
+	// With open registration disabled only administrators and holders of a registration token may register
+	regToken := r.Header.Get(regTokenHeader)
+	if Config.API.DisableRegistration && regToken == "" && !actor.isAdmin() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("registration_disabled"))
+		return
+	}
+
 	// Parse request body for domain_name
 	type RegisterRequest struct {
-		DomainName string `json:"domain_name"`
+		DomainName string   `json:"domain_name"`
 		AllowFrom  []string `json:"allowfrom"`
+		TXTSlots   int      `json:"txt_slots"`
+		Subdomain  string   `json:"subdomain"`
+		Tenant     string   `json:"tenant"`
+		MetadataUpdate
 	}
-	
+
 	var reqData RegisterRequest
 	bdata, _ := io.ReadAll(r.Body)
 	if len(bdata) > 0 {
-		_ = json.Unmarshal(bdata, &reqData)
+		err = json.Unmarshal(bdata, &reqData)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(jsonError("malformed_json_payload"))
+			return
+		}
 	}
-	
+
 	// Convert AllowFrom to cidrslice
 	var allowFrom cidrslice
 	if len(reqData.AllowFrom) > 0 {
@@ -51,16 +87,95 @@ func webRegisterPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 			return
 		}
 	}
+	// Zero means the configured default
+	if reqData.TXTSlots < 0 || reqData.TXTSlots > Config.API.MaxTXTSlots {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_txt_slots"))
+		return
+	}
+
+	// Subdomains are matched against lowercased DNS questions
+	subdomain := strings.ToLower(reqData.Subdomain)
+	if subdomain != "" && !validSubdomain(subdomain) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("bad_subdomain"))
+		return
+	}
+	if subdomain != "" && reservedSubdomain(subdomain) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("reserved_subdomain"))
+		return
+	}
+	derive := subdomain == "" && Config.API.DeriveSubdomain
 
-	// Create new user with name
-	nu, err := DB.RegisterWithName(allowFrom, reqData.DomainName)
+	if errCode := reqData.MetadataUpdate.validate(); errCode != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError(errCode))
+		return
+	}
+	var labels map[string]string
+	if reqData.Labels != nil {
+		labels = *reqData.Labels
+	}
+	var note, owner string
+	if reqData.Note != nil {
+		note = *reqData.Note
+	}
+	if reqData.Owner != nil {
+		owner = *reqData.Owner
+	}
+
+	tenant := ""
+	if actor.isAdmin() {
+		tenant, err = tenantForActor(actor, reqData.Tenant)
+	} else if reqData.Tenant != "" {
+		err = errNotOwner
+	}
 	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("forbidden"))
+		return
+	}
+
+	// Create new user with name, derived subdomains get a new suffix on collision
+	var nu ACMETxt
+	for i := 0; i < subdomainRetries; i++ {
+		if derive {
+			subdomain = deriveSubdomain(reqData.DomainName)
+			if reservedSubdomain(subdomain) {
+				err = errSubdomainTaken
+				continue
+			}
+		}
+		nu, err = DB.RegisterRecord(registration{AllowFrom: allowFrom, DomainName: reqData.DomainName, TXTSlots: reqData.TXTSlots, RegToken: regToken, Subdomain: subdomain, TenantID: tenant, Labels: labels, Note: note, Owner: owner, Actor: actor})
+		if err != errSubdomainTaken || !derive {
+			break
+		}
+	}
+	if err == errSubdomainTaken {
+		reg = jsonError("subdomain_taken")
+		regStatus = http.StatusConflict
+	} else if err == errNoTenant {
+		reg = jsonError("unknown_tenant")
+		regStatus = http.StatusBadRequest
+	} else if err == errInvalidRegToken {
+		log.WithFields(log.Fields{"domain_name": reqData.DomainName}).Info("Registration with an invalid registration token")
+		reg = jsonError("invalid_registration_token")
+		regStatus = http.StatusForbidden
+	} else if err != nil {
+		dbErrors.Inc()
 		errstr := fmt.Sprintf("%v", err)
 		reg = jsonError(errstr)
 		regStatus = http.StatusInternalServerError
 		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error in registration")
 	} else {
 		log.WithFields(log.Fields{"user": nu.Username.String()}).Debug("Created new user")
+		registrations.Inc()
 		regStruct := RegResponse{nu.Username.String(), nu.Password, nu.Subdomain + "." + Config.General.Domain, nu.Subdomain, nu.AllowFrom.ValidEntries()}
 		regStatus = http.StatusCreated
 		reg, err = json.Marshal(regStruct)
@@ -95,8 +210,9 @@ func webUpdatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		updStatus = http.StatusBadRequest
 		upd = jsonError("bad_txt")
 	} else if validSubdomain(a.Subdomain) && validTXT(a.Value) {
-		err := DB.Update(a.ACMETxtPost)
+		err := DB.Update(Actor{Username: a.Username, Subdomain: a.Subdomain, Tenant: a.TenantID, IP: getClientIP(r)}, a.ACMETxtPost)
 		if err != nil {
+			dbErrors.Inc()
 			log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to update record")
 			updStatus = http.StatusInternalServerError
 			upd = jsonError("db_error")
@@ -111,43 +227,200 @@ func webUpdatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	_, _ = w.Write(upd)
 }
 
-// Endpoint used to check the readiness and/or liveness (health) of the server.
+// webUpdateDelete clears TXT values of the subdomain, the route is wrapped in Auth
+func webUpdateDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var updStatus int
+	var upd []byte
+	// Get user
+	a, ok := r.Context().Value(ACMETxtKey).(ACMETxt)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	if !validSubdomain(a.Subdomain) {
+		log.WithFields(log.Fields{"error": "subdomain", "subdomain": a.Subdomain, "txt": a.Value}).Debug("Bad cleanup data")
+		updStatus = http.StatusBadRequest
+		upd = jsonError("bad_subdomain")
+	} else if a.Value != "" && !validTXT(a.Value) {
+		// An empty value clears all TXT values of the subdomain
+		log.WithFields(log.Fields{"error": "txt", "subdomain": a.Subdomain, "txt": a.Value}).Debug("Bad cleanup data")
+		updStatus = http.StatusBadRequest
+		upd = jsonError("bad_txt")
+	} else {
+		err := DB.ClearTXT(Actor{Username: a.Username, Subdomain: a.Subdomain, Tenant: a.TenantID, IP: getClientIP(r)}, a.ACMETxtPost)
+		if err != nil {
+			dbErrors.Inc()
+			log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to clear record")
+			updStatus = http.StatusInternalServerError
+			upd = jsonError("db_error")
+		} else {
+			log.WithFields(log.Fields{"subdomain": a.Subdomain, "txt": a.Value}).Debug("TXT cleared")
+			updStatus = http.StatusOK
+			upd = []byte("{\"txt\": \"" + a.Value + "\"}")
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(updStatus)
+	_, _ = w.Write(upd)
+}
+
+// Endpoint used to check the liveness (health) of the server, kept for existing health checks next to /health/live
 func healthCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	w.WriteHeader(http.StatusOK)
 }
 
 // DomainResponse is a struct for domain list response JSON
 type DomainResponse struct {
-	Username   string   `json:"username"`
-	Fulldomain string   `json:"fulldomain"`
-	Subdomain  string   `json:"subdomain"`
-	Allowfrom  []string `json:"allowfrom"`
-	DomainName string   `json:"domain_name"`
-	CreatedAt  int64    `json:"created_at"`
-	UpdatedAt  int64    `json:"updated_at"`
+	Username   string            `json:"username"`
+	Fulldomain string            `json:"fulldomain"`
+	Subdomain  string            `json:"subdomain"`
+	Allowfrom  []string          `json:"allowfrom"`
+	DomainName string            `json:"domain_name"`
+	CreatedAt  int64             `json:"created_at"`
+	UpdatedAt  int64             `json:"updated_at"`
+	TXTSlots   int               `json:"txt_slots"`
+	RegToken   string            `json:"reg_token"`
+	TenantID   string            `json:"tenant_id"`
+	Labels     map[string]string `json:"labels"`
+	Note       string            `json:"note"`
+	Owner      string            `json:"owner"`
+}
+
+// Page sizes of the domains list
+const (
+	defaultDomainLimit = 100
+	maxDomainLimit     = 1000
+)
+
+// DomainQuery filters the registered domains, zero values match everything. Records must have all of the Labels,
+// Search matches a substring of the subdomain or the domain name. Records are sorted by SortBy, either
+// "created_at" or "updated_at", and returned after the Cursor.
+type DomainQuery struct {
+	TenantID   string
+	Labels     map[string]string
+	Search     string
+	SortBy     string
+	Descending bool
+	Cursor     *DomainCursor
+	Limit      int
+}
+
+// DomainCursor is the position of the last record of a page in the sort order
+type DomainCursor struct {
+	Value    int64
+	Username string
+}
+
+// String encodes the cursor for the X-Next-Cursor header
+func (c DomainCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.Value, 10) + "/" + c.Username))
+}
+
+func parseDomainCursor(s string) (*DomainCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	value, username, ok := strings.Cut(string(raw), "/")
+	if !ok {
+		return nil, errors.New("invalid cursor")
+	}
+	c := DomainCursor{Username: username}
+	c.Value, err = strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
 }
 
-// webGetDomains returns all registered domains from the database
+// webGetDomains returns a page of the registered domains from the database, the route is wrapped in AdminAuth.
+// Tenant administrators only see the domains of their tenant. The number of matching domains is sent in the
+// X-Total-Count header and the cursor for the next page in the X-Next-Cursor header.
 func webGetDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	// Simple auth check - you might want to add proper authentication here
-	apiKey := r.Header.Get("X-Api-Key")
-	if apiKey == "" {
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	params := r.URL.Query()
+	q := DomainQuery{
+		TenantID: params.Get("tenant"),
+		Labels:   map[string]string{},
+		Search:   params.Get("search"),
+		SortBy:   "created_at",
+		Limit:    defaultDomainLimit,
+	}
+	if !actor.isSuperadmin() {
+		q.TenantID = actor.Tenant
+	}
+	var err error
+	if v := params.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 1 || q.Limit > maxDomainLimit {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(jsonError("invalid_limit"))
+			return
+		}
+	}
+	if v := params.Get("cursor"); v != "" {
+		q.Cursor, err = parseDomainCursor(v)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(jsonError("invalid_cursor"))
+			return
+		}
+	}
+	if v := params.Get("sort"); v != "" {
+		// A leading minus sorts in descending order
+		q.SortBy = strings.TrimPrefix(v, "-")
+		q.Descending = q.SortBy != v
+		if q.SortBy != "created_at" && q.SortBy != "updated_at" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(jsonError("invalid_sort"))
+			return
+		}
+	}
+	for _, filter := range params["label"] {
+		name, value, ok := parseLabelFilter(filter)
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(jsonError("invalid_label"))
+			return
+		}
+		q.Labels[name] = value
+	}
+	total, err := DB.CountDomains(q)
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error counting domains")
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		_, _ = w.Write(jsonError("unauthorized"))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
 		return
 	}
-
-	domains, err := DB.GetAllDomains()
+	// One more than asked for tells if there is a next page
+	limit := q.Limit
+	q.Limit++
+	domains, err := DB.GetDomains(q)
 	if err != nil {
+		dbErrors.Inc()
 		log.WithFields(log.Fields{"error": err.Error()}).Error("Error fetching domains")
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write(jsonError("db_error"))
 		return
 	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if len(domains) > limit {
+		domains = domains[:limit]
+		last := domains[limit-1]
+		next := DomainCursor{Value: last.CreatedAt, Username: last.Username.String()}
+		if q.SortBy == "updated_at" {
+			next.Value = last.UpdatedAt
+		}
+		w.Header().Set("X-Next-Cursor", next.String())
+	}
 
-	var response []DomainResponse
+	response := []DomainResponse{}
 	for _, domain := range domains {
 		resp := DomainResponse{
 			Username:   domain.Username.String(),
@@ -157,6 +430,12 @@ func webGetDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 			DomainName: domain.DomainName,
 			CreatedAt:  domain.CreatedAt,
 			UpdatedAt:  domain.UpdatedAt,
+			TXTSlots:   domain.TXTSlots,
+			RegToken:   domain.RegToken,
+			TenantID:   domain.TenantID,
+			Labels:     domain.Labels,
+			Note:       domain.Note,
+			Owner:      domain.Owner,
 		}
 		response = append(response, resp)
 	}
@@ -174,3 +453,161 @@ func webGetDomains(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(respJSON)
 }
+
+// webDeleteDomain removes a registration and its TXT values, the route is wrapped in ActorAuth
+func webDeleteDomain(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	actor, ok := r.Context().Value(ActorKey).(Actor)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	subdomain := p.ByName("subdomain")
+	if !validSubdomain(subdomain) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("bad_subdomain"))
+		return
+	}
+
+	err := DB.DeleteRecord(actor, subdomain)
+	credCache.invalidate(subdomain)
+	if err == errNotOwner {
+		log.WithFields(log.Fields{"error": "subdomain_mismatch", "subdomain": subdomain, "user": actor.Username.String()}).Error("Deregistration not allowed")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("forbidden"))
+		return
+	}
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Error("Error deleting record")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+
+	log.WithFields(log.Fields{"subdomain": subdomain}).Debug("Record deleted")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("{\"subdomain\": \"" + subdomain + "\"}"))
+}
+
+// webUpdateAllowFrom replaces the allowed source networks of a registration, the route is wrapped in ActorAuth
+func webUpdateAllowFrom(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	actor, ok := r.Context().Value(ActorKey).(Actor)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	subdomain := p.ByName("subdomain")
+	if !validSubdomain(subdomain) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("bad_subdomain"))
+		return
+	}
+	var reqData struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("malformed_json_payload"))
+		return
+	}
+	allowFrom := cidrslice(reqData.AllowFrom)
+	if err = allowFrom.isValid(); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_allowfrom_cidr"))
+		return
+	}
+
+	err = DB.UpdateAllowFrom(actor, subdomain, allowFrom)
+	// Cached verifications hold the old allowfrom list
+	credCache.invalidate(subdomain)
+	if err == errNotOwner {
+		log.WithFields(log.Fields{"error": "subdomain_mismatch", "subdomain": subdomain, "user": actor.Username.String()}).Error("Allowfrom update not allowed")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("forbidden"))
+		return
+	}
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Error("Error updating allowfrom")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+
+	log.WithFields(log.Fields{"subdomain": subdomain, "allowfrom": allowFrom.ValidEntries()}).Debug("Allowfrom updated")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"allowfrom": allowFrom.ValidEntries()})
+}
+
+// webUpdateTXTSlots changes the number of TXT values kept for a registration, the route is wrapped in AdminAuth
+func webUpdateTXTSlots(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	actor, ok := r.Context().Value(ActorKey).(Actor)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	subdomain := p.ByName("subdomain")
+	if !validSubdomain(subdomain) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("bad_subdomain"))
+		return
+	}
+	var reqData struct {
+		TXTSlots int `json:"txt_slots"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("malformed_json_payload"))
+		return
+	}
+	if reqData.TXTSlots < 1 || reqData.TXTSlots > Config.API.MaxTXTSlots {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_txt_slots"))
+		return
+	}
+
+	err = DB.SetTXTSlots(actor, subdomain, reqData.TXTSlots)
+	if err == errNoRecord || err == errNotOwner {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Error("Error updating TXT slots")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+
+	log.WithFields(log.Fields{"subdomain": subdomain, "txt_slots": reqData.TXTSlots}).Debug("TXT slots updated")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"subdomain": subdomain, "txt_slots": reqData.TXTSlots})
+}
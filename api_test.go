@@ -6,13 +6,16 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gavv/httpexpect"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // noAuth function to write ACMETxt model to context while not preforming any validation
@@ -46,37 +49,75 @@ func getExpect(t *testing.T, server *httptest.Server) *httpexpect.Expect {
 	})
 }
 
+// registerTestUser registers a new user allowed to update from afrom
+func registerTestUser(t *testing.T, afrom ...string) ACMETxt {
+	t.Helper()
+	user, err := DB.Register(cidrslice(afrom))
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	return user
+}
+
+// withAdminToken accepts "secret-admin-token" as an admin bearer token until the test ends
+func withAdminToken(t *testing.T) {
+	Config.Admin = adminconfig{Tokens: []string{"secret-admin-token"}}
+	t.Cleanup(func() { Config.Admin = adminconfig{} })
+}
+
 func setupRouter(debug bool, noauth bool) http.Handler {
-	api := httprouter.New()
+	api := newAPIRouter()
 	var dbcfg = dbsettings{
 		Engine:     "sqlite3",
 		Connection: ":memory:"}
 	var httpapicfg = httpapi{
-		Domain:      "",
-		Port:        "8080",
-		TLS:         "none",
-		CorsOrigins: []string{"*"},
-		UseHeader:   true,
-		HeaderName:  "X-Forwarded-For",
+		Domain:         "",
+		Port:           "8080",
+		TLS:            "none",
+		CorsOrigins:    []string{"*"},
+		UseHeader:      true,
+		HeaderName:     "X-Forwarded-For",
+		TrustedProxies: []string{"127.0.0.1/32", "::1/128"},
 	}
 	var dnscfg = DNSConfig{
 		API:      httpapicfg,
 		Database: dbcfg,
+		Hashing:  hashconfig{}.withDefaults(),
 	}
 	Config = dnscfg
 	c := cors.New(cors.Options{
 		AllowedOrigins:     Config.API.CorsOrigins,
-		AllowedMethods:     []string{"GET", "POST"},
+		AllowedMethods:     []string{"GET", "POST", "DELETE", "PATCH"},
+		ExposedHeaders:     []string{"X-Total-Count", "X-Next-Cursor"},
 		OptionsPassthrough: false,
 		Debug:              Config.General.Debug,
 	})
 	api.POST("/register", webRegisterPost)
 	api.GET("/health", healthCheck)
+	api.GET("/domains", AdminAuth(webGetDomains))
+	api.POST("/updatename", ActorAuth(webUpdateName))
+	api.DELETE("/domains/:subdomain", ActorAuth(webDeleteDomain))
+	api.PATCH("/domains/:subdomain/allowfrom", ActorAuth(webUpdateAllowFrom))
+	api.PATCH("/domains/:subdomain/txtslots", AdminAuth(webUpdateTXTSlots))
+	api.PATCH("/domains/:subdomain", ActorAuth(webUpdateMetadata))
+	api.POST("/rotate", ActorAuth(webRotatePost))
+	api.POST("/regtokens", AdminAuth(webRegTokenPost))
+	api.GET("/regtokens", AdminAuth(webGetRegTokens))
+	api.DELETE("/regtokens/:id", AdminAuth(webDeleteRegToken))
+	api.GET("/lockouts", SuperadminAuth(webGetLockouts))
+	api.DELETE("/lockouts/:kind/:value", SuperadminAuth(webDeleteLockout))
+	api.GET("/audit", AdminAuth(webGetAudit))
+	api.POST("/tenants", SuperadminAuth(webTenantPost))
+	api.GET("/tenants", SuperadminAuth(webGetTenants))
+	api.POST("/tenants/:id/token", SuperadminAuth(webTenantTokenPost))
+	api.DELETE("/tenants/:id", SuperadminAuth(webDeleteTenant))
+	api.GET("/metrics", SuperadminAuth(webGetMetrics))
 	if noauth {
 		api.POST("/update", noAuth(webUpdatePost))
 	} else {
 		api.POST("/update", Auth(webUpdatePost))
 	}
+	api.DELETE("/update", Auth(webUpdateDelete))
 	return c.Handler(api)
 }
 
@@ -412,7 +453,9 @@ func TestApiManyUpdateWithIpCheckHeaders(t *testing.T) {
 		{newUser, "10.0.0.1, 1.2.3.4 ,3.4.5.6", 200},
 		{newUserWithCIDR, "127.0.0.1", 401},
 		{newUserWithCIDR, "10.0.0.1, 10.0.0.2, 192.168.1.3", 401},
-		{newUserWithCIDR, "10.1.1.1 ,192.168.1.2, 8.8.8.8", 200},
+		{newUserWithCIDR, "10.1.1.1 ,192.168.1.2, 8.8.8.8", 401},
+		{newUserWithCIDR, "8.8.8.8, 192.168.1.2", 200},
+		{newUserWithCIDR, "8.8.8.8, 192.168.1.2, 127.0.0.1", 200},
 		{newUserWithIP6CIDR, "2002:c0a8:b4dc:0d3::0", 200},
 		{newUserWithIP6CIDR, "2002:c0a7:0ff::0", 401},
 		{newUserWithIP6CIDR, "2002:c0a8:d3ad:b33f:c0ff:33b4:dc0d:3b4d", 200},
@@ -428,6 +471,19 @@ func TestApiManyUpdateWithIpCheckHeaders(t *testing.T) {
 			Expect().
 			Status(test.status)
 	}
+
+	// The header is ignored for requests not coming from a trusted proxy
+	Config.API.TrustedProxies = []string{"10.0.0.0/8"}
+	e.POST("/update").
+		WithJSON(map[string]interface{}{
+			"subdomain": newUserWithCIDR.Subdomain,
+			"txt":       "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}).
+		WithHeader("X-Api-User", newUserWithCIDR.Username.String()).
+		WithHeader("X-Api-Key", newUserWithCIDR.Password).
+		WithHeader("X-Forwarded-For", "192.168.1.2").
+		Expect().
+		Status(http.StatusUnauthorized)
+	Config.API.TrustedProxies = []string{"127.0.0.1/32", "::1/128"}
 	Config.API.UseHeader = false
 }
 
@@ -438,3 +494,955 @@ func TestApiHealthCheck(t *testing.T) {
 	e := getExpect(t, server)
 	e.GET("/health").Expect().Status(http.StatusOK)
 }
+
+func TestApiGetDomainsAdminAuth(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	adminHash, _ := bcrypt.GenerateFromPassword([]byte("adminpass"), bcrypt.MinCost)
+	Config.Admin = adminconfig{
+		Tokens: []string{"", "secret-admin-token"},
+		Users:  []adminuser{{Username: "admin", Password: string(adminHash)}},
+	}
+	defer func() { Config.Admin = adminconfig{} }()
+
+	e.GET("/domains").Expect().
+		Status(http.StatusUnauthorized).
+		JSON().Object().
+		ValueEqual("error", "unauthorized")
+	e.GET("/domains").
+		WithHeader("X-Api-Key", "whatever").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/domains").
+		WithHeader("Authorization", "Bearer wrong-token").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/domains").
+		WithHeader("Authorization", "Bearer ").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/domains").
+		WithBasicAuth("admin", "wrongpass").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/domains").
+		WithBasicAuth("nobody", "adminpass").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/domains").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	e.GET("/domains").
+		WithBasicAuth("admin", "adminpass").
+		Expect().
+		Status(http.StatusOK)
+}
+
+func TestApiUpdateName(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	Config.General.Domain = "auth.example.org"
+	withAdminToken(t)
+
+	owner := registerTestUser(t)
+	other := registerTestUser(t)
+
+	for _, test := range []struct {
+		user       string
+		pass       string
+		token      string
+		fulldomain string
+		status     int
+	}{
+		{"", "", "", owner.Subdomain + ".auth.example.org", http.StatusUnauthorized},
+		{owner.Username.String(), "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", "", owner.Subdomain + ".auth.example.org", http.StatusUnauthorized},
+		{owner.Username.String(), owner.Password, "", owner.Subdomain + ".auth.example.org", http.StatusOK},
+		{owner.Username.String(), owner.Password, "", other.Subdomain + ".auth.example.org", http.StatusForbidden},
+		{owner.Username.String(), owner.Password, "", "doesnotexist.auth.example.org", http.StatusForbidden},
+		{"", "", "wrong-token", other.Subdomain + ".auth.example.org", http.StatusUnauthorized},
+		{"", "", "secret-admin-token", other.Subdomain + ".auth.example.org", http.StatusOK},
+		{"", "", "secret-admin-token", "doesnotexist.auth.example.org", http.StatusNotFound},
+	} {
+		req := e.POST("/updatename").
+			WithJSON(map[string]interface{}{"fulldomain": test.fulldomain, "domain_name": "example.com"})
+		if test.user != "" {
+			req = req.WithHeader("X-Api-User", test.user).WithHeader("X-Api-Key", test.pass)
+		}
+		if test.token != "" {
+			req = req.WithHeader("Authorization", "Bearer "+test.token)
+		}
+		resp := req.Expect().Status(test.status)
+		if test.status != http.StatusOK {
+			resp.JSON().Object().ContainsKey("error")
+		}
+	}
+}
+
+func TestApiDeleteDomain(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+
+	owner := registerTestUser(t)
+	other := registerTestUser(t)
+
+	e.DELETE("/domains/" + owner.Subdomain).Expect().
+		Status(http.StatusUnauthorized)
+	e.DELETE("/domains/"+other.Subdomain).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().
+		ValueEqual("error", "forbidden")
+	e.DELETE("/domains/"+owner.Subdomain).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("subdomain", owner.Subdomain)
+	// Credentials are gone with the record
+	e.DELETE("/domains/"+owner.Subdomain).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.DELETE("/domains/"+other.Subdomain).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	e.DELETE("/domains/"+other.Subdomain).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusNotFound)
+}
+
+func TestApiRotate(t *testing.T) {
+	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+
+	owner := registerTestUser(t)
+	other := registerTestUser(t)
+	update := func(password string, status int) {
+		e.POST("/update").
+			WithJSON(map[string]interface{}{"subdomain": owner.Subdomain, "txt": validTxtData}).
+			WithHeader("X-Api-User", owner.Username.String()).
+			WithHeader("X-Api-Key", password).
+			Expect().
+			Status(status)
+	}
+
+	e.POST("/rotate").Expect().Status(http.StatusUnauthorized)
+	e.POST("/rotate").
+		WithJSON(map[string]interface{}{"subdomain": other.Subdomain}).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		Expect().
+		Status(http.StatusForbidden)
+	e.POST("/rotate").
+		WithJSON(map[string]interface{}{"grace_minutes": -1}).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "invalid_grace_minutes")
+
+	// Without grace period the old password stops working immediately
+	rotated := e.POST("/rotate").
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object()
+	rotated.ValueEqual("username", owner.Username.String())
+	rotated.ValueEqual("subdomain", owner.Subdomain)
+	firstPassword := rotated.Value("password").String().Raw()
+	if firstPassword == owner.Password {
+		t.Errorf("Expected a new password after rotation")
+	}
+	update(owner.Password, http.StatusUnauthorized)
+	update(firstPassword, http.StatusOK)
+
+	// With a grace period both passwords are accepted
+	secondPassword := e.POST("/rotate").
+		WithJSON(map[string]interface{}{"grace_minutes": 5}).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", firstPassword).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		Value("password").String().Raw()
+	update(firstPassword, http.StatusOK)
+	update(secondPassword, http.StatusOK)
+
+	// The password in its grace period only updates the TXT records, it can not take over the record
+	e.POST("/rotate").
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", firstPassword).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.DELETE("/domains/"+owner.Subdomain).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", firstPassword).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.PATCH("/domains/"+owner.Subdomain+"/allowfrom").
+		WithJSON(map[string]interface{}{"allowfrom": []string{"192.0.2.0/24"}}).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", firstPassword).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.PATCH("/domains/"+owner.Subdomain).
+		WithJSON(map[string]interface{}{"note": "taken"}).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", firstPassword).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.DELETE("/update").
+		WithJSON(map[string]interface{}{"subdomain": owner.Subdomain, "txt": validTxtData}).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", firstPassword).
+		Expect().
+		Status(http.StatusOK)
+	update(secondPassword, http.StatusOK)
+
+	// Admins rotate any record, but have to name it
+	e.POST("/rotate").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusBadRequest)
+	e.POST("/rotate").
+		WithJSON(map[string]interface{}{"subdomain": owner.Subdomain}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	update(firstPassword, http.StatusUnauthorized)
+	update(secondPassword, http.StatusUnauthorized)
+}
+
+func TestApiUpdateTXTSlots(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	Config.API.MaxTXTSlots = 4
+	withAdminToken(t)
+
+	newUser := registerTestUser(t)
+	setSlots := func(slots int, status int) {
+		e.PATCH("/domains/"+newUser.Subdomain+"/txtslots").
+			WithJSON(map[string]interface{}{"txt_slots": slots}).
+			WithHeader("Authorization", "Bearer secret-admin-token").
+			Expect().
+			Status(status)
+	}
+	countSlots := func() int {
+		var n int
+		_ = DB.GetBackend().QueryRow("SELECT COUNT(*) FROM txt WHERE Subdomain=?", newUser.Subdomain).Scan(&n)
+		return n
+	}
+
+	// Owners can not change their slots
+	e.PATCH("/domains/"+newUser.Subdomain+"/txtslots").
+		WithJSON(map[string]interface{}{"txt_slots": 3}).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusUnauthorized)
+	setSlots(0, http.StatusBadRequest)
+	setSlots(5, http.StatusBadRequest)
+	e.PATCH("/domains/unknown-zone/txtslots").
+		WithJSON(map[string]interface{}{"txt_slots": 3}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusNotFound)
+
+	setSlots(4, http.StatusOK)
+	if n := countSlots(); n != 4 {
+		t.Errorf("Expected [4] TXT slots, got [%d]", n)
+	}
+	newUser.Value = "___validation_token_received_from_the_ca___"
+	_ = DB.Update(Actor{}, newUser.ACMETxtPost)
+	// The most recently updated value is kept
+	setSlots(1, http.StatusOK)
+	txts, _ := DB.GetTXTForDomain(newUser.Subdomain)
+	if len(txts) != 1 || txts[0] != newUser.Value {
+		t.Errorf("Expected the updated value to be kept, got %v", txts)
+	}
+	var recorded int
+	_ = DB.GetBackend().QueryRow("SELECT TXTSlots FROM records WHERE Subdomain=?", newUser.Subdomain).Scan(&recorded)
+	if recorded != 1 {
+		t.Errorf("Expected [1] TXT slot recorded, got [%d]", recorded)
+	}
+}
+
+func TestApiUpdateDelete(t *testing.T) {
+	validTxtData := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	newUser := registerTestUser(t)
+	newUser.Value = validTxtData
+	_ = DB.Update(Actor{}, newUser.ACMETxtPost)
+
+	for _, test := range []struct {
+		user      string
+		pass      string
+		subdomain string
+		txt       string
+		status    int
+	}{
+		{"", "", newUser.Subdomain, validTxtData, http.StatusUnauthorized},
+		{newUser.Username.String(), newUser.Password, "a097455b-52cc-4569-90c8-7a4b97c6eba8", validTxtData, http.StatusUnauthorized},
+		{newUser.Username.String(), newUser.Password, newUser.Subdomain, "tooshortfortxt", http.StatusBadRequest},
+		{newUser.Username.String(), newUser.Password, newUser.Subdomain, validTxtData, http.StatusOK},
+		{newUser.Username.String(), newUser.Password, newUser.Subdomain, "", http.StatusOK},
+	} {
+		e.DELETE("/update").
+			WithJSON(map[string]interface{}{"subdomain": test.subdomain, "txt": test.txt}).
+			WithHeader("X-Api-User", test.user).
+			WithHeader("X-Api-Key", test.pass).
+			Expect().
+			Status(test.status)
+	}
+	txts, _ := DB.GetTXTForDomain(newUser.Subdomain)
+	for _, v := range txts {
+		if v != "" {
+			t.Errorf("Expected TXT values to be cleared, got [%s]", v)
+		}
+	}
+}
+
+func TestApiRegisterTXTSlots(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	Config.API.TXTSlots = 2
+	Config.API.MaxTXTSlots = 4
+
+	for _, slots := range []int{-1, 5} {
+		e.POST("/register").
+			WithJSON(map[string]interface{}{"txt_slots": slots}).
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().
+			ValueEqual("error", "invalid_txt_slots")
+	}
+	subdomain := e.POST("/register").
+		WithJSON(map[string]interface{}{"txt_slots": 4}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().
+		Value("subdomain").String().Raw()
+	txts, _ := DB.GetTXTForDomain(subdomain)
+	if len(txts) != 4 {
+		t.Errorf("Expected [4] TXT slots, got [%d]", len(txts))
+	}
+}
+
+func TestApiUpdateAllowFrom(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+
+	owner := registerTestUser(t, "10.0.0.0/8")
+	other := registerTestUser(t)
+	newAllowFrom := map[string]interface{}{"allowfrom": []string{"192.168.0.0/16", "[::1]/64"}}
+
+	e.PATCH("/domains/" + owner.Subdomain + "/allowfrom").
+		WithJSON(newAllowFrom).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.PATCH("/domains/"+other.Subdomain+"/allowfrom").
+		WithJSON(newAllowFrom).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		WithHeader("X-Forwarded-For", "10.1.1.1").
+		Expect().
+		Status(http.StatusForbidden)
+	e.PATCH("/domains/"+owner.Subdomain+"/allowfrom").
+		WithJSON(map[string]interface{}{"allowfrom": []string{"1.2.3.4/33"}}).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		WithHeader("X-Forwarded-For", "10.1.1.1").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "invalid_allowfrom_cidr")
+	e.PATCH("/domains/"+owner.Subdomain+"/allowfrom").
+		WithJSON(newAllowFrom).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		WithHeader("X-Forwarded-For", "10.1.1.1").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		Value("allowfrom").Array().Elements("192.168.0.0/16", "::1/64")
+	updated, _ := DB.GetByUsername(owner.Username)
+	if len(updated.AllowFrom) != 2 {
+		t.Errorf("Expected allowfrom to be persisted, got [%v]", updated.AllowFrom)
+	}
+	// The old network is not allowed anymore
+	e.PATCH("/domains/"+owner.Subdomain+"/allowfrom").
+		WithJSON(newAllowFrom).
+		WithHeader("X-Api-User", owner.Username.String()).
+		WithHeader("X-Api-Key", owner.Password).
+		WithHeader("X-Forwarded-For", "10.1.1.1").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.PATCH("/domains/"+owner.Subdomain+"/allowfrom").
+		WithJSON(map[string]interface{}{"allowfrom": []string{}}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		Value("allowfrom").Array().Empty()
+}
+
+func TestApiRegTokens(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+	Config.API.DisableRegistration = true
+	defer func() { Config.API.DisableRegistration = false }()
+
+	e.POST("/regtokens").
+		WithJSON(map[string]interface{}{}).
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.POST("/regtokens").
+		WithJSON(map[string]interface{}{"domain_pattern": "[", "max_uses": 1}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "invalid_domain_pattern")
+	e.POST("/regtokens").
+		WithJSON(map[string]interface{}{"max_uses": -1}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "invalid_max_uses")
+	created := e.POST("/regtokens").
+		WithJSON(map[string]interface{}{"domain_pattern": "*.example.com", "expires_in_minutes": 60}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	created.ValueEqual("max_uses", 1)
+	token := created.Value("token").String().Raw()
+	id := created.Value("id").String().Raw()
+
+	e.POST("/register").Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().
+		ValueEqual("error", "registration_disabled")
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"domain_name": "www.example.com"}).
+		WithHeader("X-Registration-Token", "bogus").
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().
+		ValueEqual("error", "invalid_registration_token")
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"domain_name": "www.example.org"}).
+		WithHeader("X-Registration-Token", token).
+		Expect().
+		Status(http.StatusForbidden).
+		JSON().Object().
+		ValueEqual("error", "invalid_registration_token")
+	subdomain := e.POST("/register").
+		WithJSON(map[string]interface{}{"domain_name": "www.example.com"}).
+		WithHeader("X-Registration-Token", token).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().
+		Value("subdomain").String().Raw()
+	// One-time token is used up
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"domain_name": "www.example.com"}).
+		WithHeader("X-Registration-Token", token).
+		Expect().
+		Status(http.StatusForbidden)
+
+	domains := e.GET("/domains").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	for _, domain := range domains.Iter() {
+		if domain.Object().Value("subdomain").String().Raw() == subdomain {
+			domain.Object().ValueEqual("reg_token", id)
+		}
+	}
+	listed := e.GET("/regtokens").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	for _, listedToken := range listed.Iter() {
+		listedToken.Object().NotContainsKey("token")
+		if listedToken.Object().Value("id").String().Raw() == id {
+			listedToken.Object().ValueEqual("uses", 1)
+		}
+	}
+	e.DELETE("/regtokens/"+id).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	e.DELETE("/regtokens/"+id).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusNotFound)
+}
+
+func TestApiRegisterSubdomain(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	Config.API.ReservedSubdomains = []string{"www"}
+	defer func() {
+		Config.API.ReservedSubdomains = nil
+		Config.API.DeriveSubdomain = false
+	}()
+
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"subdomain": "Customer-One"}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().
+		ValueEqual("subdomain", "customer-one")
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"subdomain": "customer-one"}).
+		Expect().
+		Status(http.StatusConflict).
+		JSON().Object().
+		ValueEqual("error", "subdomain_taken")
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"subdomain": "-bad_name"}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "bad_subdomain")
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"subdomain": "WWW"}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().
+		ValueEqual("error", "reserved_subdomain")
+
+	Config.API.DeriveSubdomain = true
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"domain_name": "example.com"}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().
+		Value("subdomain").String().Match("^example-com-[0-9a-f]{4}$")
+	// A requested subdomain takes precedence
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"domain_name": "example.com", "subdomain": "customer-two"}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().
+		ValueEqual("subdomain", "customer-two")
+}
+
+func TestApiLockout(t *testing.T) {
+	validTxtData := "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+	Config.Lockout = lockoutconfig{Threshold: 2, BaseSeconds: 60, MaxMinutes: 60}
+	defer func() {
+		Config.Lockout = lockoutconfig{}
+		lockouts = newLockoutTracker()
+	}()
+	newUser := registerTestUser(t)
+	update := map[string]interface{}{"subdomain": newUser.Subdomain, "txt": validTxtData}
+
+	for i := 0; i < 2; i++ {
+		e.POST("/update").
+			WithJSON(update).
+			WithHeader("X-Api-User", newUser.Username.String()).
+			WithHeader("X-Api-Key", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa").
+			WithHeader("X-Forwarded-For", "10.0.0.1").
+			Expect().
+			Status(http.StatusUnauthorized)
+	}
+	// Locked out even with the correct key, from any IP
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		WithHeader("X-Forwarded-For", "10.0.0.2").
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	lockedOut := e.GET("/lockouts").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	lockedOut.Length().Equal(2)
+	lockedOut.Element(0).Object().ValueEqual("failures", 2)
+
+	e.DELETE("/lockouts/user/"+newUser.Username.String()).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	e.DELETE("/lockouts/user/"+newUser.Username.String()).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusNotFound)
+	e.DELETE("/lockouts/host/10.0.0.1").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusBadRequest)
+	// The IP used for guessing stays locked out
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		WithHeader("X-Forwarded-For", "10.0.0.1").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		WithHeader("X-Forwarded-For", "10.0.0.2").
+		Expect().
+		Status(http.StatusOK)
+}
+
+func TestApiCredentialCacheInvalidation(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	Config.CredentialCache = credentialcacheconfig{TTLSeconds: 60, Size: 10}
+	defer func() { Config.CredentialCache = credentialcacheconfig{} }()
+	newUser := registerTestUser(t)
+	update := map[string]interface{}{"subdomain": newUser.Subdomain, "txt": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK)
+	if _, ok := credCache.get(newUser.Username, newUser.Password, time.Now()); !ok {
+		t.Errorf("Expected credential to be cached after update")
+	}
+	e.POST("/rotate").
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK)
+	// The old key is no longer accepted from the cache
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestApiAudit(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+	newUser := registerTestUser(t)
+	update := map[string]interface{}{"subdomain": newUser.Subdomain, "txt": "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	e.POST("/update").
+		WithJSON(update).
+		WithHeader("X-Api-User", newUser.Username.String()).
+		WithHeader("X-Api-Key", newUser.Password).
+		Expect().
+		Status(http.StatusOK)
+
+	e.GET("/audit").
+		Expect().
+		Status(http.StatusUnauthorized)
+	e.GET("/audit").
+		WithQuery("limit", 0).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().ValueEqual("error", "invalid_limit")
+
+	resp := e.GET("/audit").
+		WithQuery("subdomain", newUser.Subdomain).
+		WithQuery("limit", 1).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	first := resp.JSON().Array()
+	first.Length().Equal(1)
+	first.Element(0).Object().ValueEqual("action", auditUpdateTXT)
+	first.Element(0).Object().ValueEqual("actor", "user:"+newUser.Username.String())
+	first.Element(0).Object().ValueEqual("new_value", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	cursor := resp.Header("X-Next-Cursor").NotEmpty().Raw()
+
+	resp = e.GET("/audit").
+		WithQuery("subdomain", newUser.Subdomain).
+		WithQuery("cursor", cursor).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	resp.Header("X-Next-Cursor").Empty()
+	second := resp.JSON().Array()
+	second.Length().Equal(1)
+	second.Element(0).Object().ValueEqual("action", auditRegister)
+}
+
+func TestApiTenants(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+
+	e.POST("/tenants").
+		WithJSON(map[string]interface{}{"name": "bad name"}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().ValueEqual("error", "invalid_name")
+	team := e.POST("/tenants").
+		WithJSON(map[string]interface{}{"name": "api-team-a"}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	teamID := team.Value("id").String().Raw()
+	teamToken := team.Value("token").String().NotEmpty().Raw()
+	otherToken := e.POST("/tenants").
+		WithJSON(map[string]interface{}{"name": "api-team-b"}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object().Value("token").String().Raw()
+	e.POST("/tenants").
+		WithJSON(map[string]interface{}{"name": "api-team-a"}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusConflict)
+
+	// Tenant administrators can not manage tenants or lockouts
+	e.GET("/tenants").
+		WithHeader("Authorization", "Bearer "+teamToken).
+		Expect().
+		Status(http.StatusForbidden)
+	e.GET("/lockouts").
+		WithHeader("Authorization", "Bearer "+teamToken).
+		Expect().
+		Status(http.StatusForbidden)
+
+	// Records registered by a tenant administrator belong to the tenant
+	reg := e.POST("/register").
+		WithHeader("Authorization", "Bearer "+teamToken).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	subdomain := reg.Value("subdomain").String().Raw()
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"tenant": teamID}).
+		Expect().
+		Status(http.StatusForbidden)
+	e.POST("/register").
+		WithHeader("Authorization", "Bearer not-a-token").
+		Expect().
+		Status(http.StatusUnauthorized)
+
+	domains := e.GET("/domains").
+		WithHeader("Authorization", "Bearer "+teamToken).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	domains.Length().Equal(1)
+	domains.Element(0).Object().ValueEqual("subdomain", subdomain)
+	domains.Element(0).Object().ValueEqual("tenant_id", teamID)
+	e.GET("/domains").
+		WithHeader("Authorization", "Bearer "+otherToken).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array().Empty()
+
+	// Records of other tenants look like they do not exist
+	e.DELETE("/domains/"+subdomain).
+		WithHeader("Authorization", "Bearer "+otherToken).
+		Expect().
+		Status(http.StatusNotFound)
+	e.GET("/audit").
+		WithQuery("subdomain", subdomain).
+		WithHeader("Authorization", "Bearer "+otherToken).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array().Length().Equal(0)
+	e.GET("/audit").
+		WithQuery("subdomain", subdomain).
+		WithHeader("Authorization", "Bearer "+teamToken).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array().Element(0).Object().ValueEqual("actor", "tenant:api-team-a")
+
+	e.DELETE("/tenants/"+teamID).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusConflict)
+	e.DELETE("/domains/"+subdomain).
+		WithHeader("Authorization", "Bearer "+teamToken).
+		Expect().
+		Status(http.StatusOK)
+	e.DELETE("/tenants/"+teamID).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	e.GET("/domains").
+		WithHeader("Authorization", "Bearer "+teamToken).
+		Expect().
+		Status(http.StatusUnauthorized)
+}
+
+func TestApiMetadata(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+
+	e.POST("/register").
+		WithJSON(map[string]interface{}{"labels": map[string]string{"bad label": "x"}}).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().ValueEqual("error", "invalid_labels")
+	reg := e.POST("/register").
+		WithJSON(map[string]interface{}{"labels": map[string]string{"team": "api-payments"}, "owner": "ops@example.com"}).
+		Expect().
+		Status(http.StatusCreated).
+		JSON().Object()
+	user := reg.Value("username").String().Raw()
+	key := reg.Value("password").String().Raw()
+	subdomain := reg.Value("subdomain").String().Raw()
+
+	domains := e.GET("/domains").
+		WithQuery("label", "team=api-payments").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array()
+	domains.Length().Equal(1)
+	domains.Element(0).Object().ValueEqual("owner", "ops@example.com")
+	domains.Element(0).Object().Value("labels").Object().ValueEqual("team", "api-payments")
+	e.GET("/domains").
+		WithQuery("label", "team").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().ValueEqual("error", "invalid_label")
+
+	e.PATCH("/domains/"+subdomain).
+		WithJSON(map[string]interface{}{"note": "renewed by cron"}).
+		WithHeader("X-Api-User", user).
+		WithHeader("X-Api-Key", key).
+		Expect().
+		Status(http.StatusOK).
+		JSON().Object().
+		ValueEqual("note", "renewed by cron").
+		ValueEqual("owner", "ops@example.com")
+	e.PATCH("/domains/"+subdomain).
+		WithJSON(map[string]interface{}{"owner": "nobody"}).
+		WithHeader("X-Api-User", user).
+		WithHeader("X-Api-Key", key).
+		Expect().
+		Status(http.StatusBadRequest).
+		JSON().Object().ValueEqual("error", "invalid_owner")
+	e.PATCH("/domains/"+subdomain).
+		WithJSON(map[string]interface{}{"labels": map[string]string{}}).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	e.GET("/domains").
+		WithQuery("label", "team=api-payments").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK).
+		JSON().Array().Empty()
+}
+
+func TestApiDomainsPagination(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+	for i := 0; i < 3; i++ {
+		e.POST("/register").
+			WithJSON(map[string]interface{}{"domain_name": "api-paging-" + strconv.Itoa(i) + ".example.com"}).
+			Expect().
+			Status(http.StatusCreated)
+	}
+
+	for _, param := range []struct{ name, value, errCode string }{
+		{"limit", "0", "invalid_limit"},
+		{"limit", "1001", "invalid_limit"},
+		{"cursor", "%%%", "invalid_cursor"},
+		{"sort", "subdomain", "invalid_sort"},
+	} {
+		e.GET("/domains").
+			WithQuery(param.name, param.value).
+			WithHeader("Authorization", "Bearer secret-admin-token").
+			Expect().
+			Status(http.StatusBadRequest).
+			JSON().Object().ValueEqual("error", param.errCode)
+	}
+
+	resp := e.GET("/domains").
+		WithQuery("search", "api-paging-").
+		WithQuery("sort", "-updated_at").
+		WithQuery("limit", 2).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	resp.Header("X-Total-Count").Equal("3")
+	resp.JSON().Array().Length().Equal(2)
+	cursor := resp.Header("X-Next-Cursor").NotEmpty().Raw()
+
+	resp = e.GET("/domains").
+		WithQuery("search", "api-paging-").
+		WithQuery("sort", "-updated_at").
+		WithQuery("limit", 2).
+		WithQuery("cursor", cursor).
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+	resp.Header("X-Total-Count").Equal("3")
+	resp.Header("X-Next-Cursor").Empty()
+	resp.JSON().Array().Length().Equal(1)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Audited actions
+const (
+	auditRegister         = "register"
+	auditUpdateTXT        = "update_txt"
+	auditClearTXT         = "clear_txt"
+	auditExpireTXT        = "expire_txt"
+	auditUpdateDomainName = "update_domain_name"
+	auditUpdateAllowFrom  = "update_allowfrom"
+	auditUpdateMetadata   = "update_metadata"
+	auditUpdateTXTSlots   = "update_txt_slots"
+	auditRotatePassword   = "rotate_password"
+	auditRehashPassword   = "rehash_password"
+	auditDelete           = "delete"
+	auditCreateRegToken   = "create_regtoken"
+	auditDeleteRegToken   = "delete_regtoken"
+	auditCreateTenant     = "create_tenant"
+	auditRotateTenant     = "rotate_tenant_token"
+	auditDeleteTenant     = "delete_tenant"
+)
+
+// auditSystemActor is the actor of changes made by acme-dns itself, eg. expiring TXT values or upgrading password hashes
+const auditSystemActor = "system"
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditEntry is a row of the audit log
+type AuditEntry struct {
+	ID        int64  `json:"id"`
+	Time      int64  `json:"time"`
+	Actor     string `json:"actor"`
+	IP        string `json:"ip"`
+	Action    string `json:"action"`
+	Subdomain string `json:"subdomain"`
+	OldValue  string `json:"old_value"`
+	NewValue  string `json:"new_value"`
+	TenantID  string `json:"tenant_id"`
+}
+
+// AuditQuery filters the audit log, zero values match everything. Entries are returned newest
+// first, starting below the ID in Cursor.
+type AuditQuery struct {
+	Actor     string
+	IP        string
+	Action    string
+	Subdomain string
+	TenantID  string
+	Since     int64
+	Until     int64
+	Cursor    int64
+	Limit     int
+}
+
+// auditName identifies the actor in the audit log
+func (a Actor) auditName() string {
+	if a.isSuperadmin() {
+		return "admin:" + a.Admin
+	}
+	if a.isAdmin() {
+		return "tenant:" + a.Admin
+	}
+	if a.Username != uuid.Nil {
+		return "user:" + a.Username.String()
+	}
+	return "anonymous"
+}
+
+// writeAuditInTransaction records a change made by actor to an object of the tenant, to be committed together
+// with the change itself
+func writeAuditInTransaction(tx *sql.Tx, actor Actor, tenant string, action string, subdomain string, oldValue string, newValue string) error {
+	return insertAuditInTransaction(tx, AuditEntry{
+		TenantID:  tenant,
+		Actor:     actor.auditName(),
+		IP:        actor.IP,
+		Action:    action,
+		Subdomain: subdomain,
+		OldValue:  oldValue,
+		NewValue:  newValue,
+	})
+}
+
+func insertAuditInTransaction(tx *sql.Tx, e AuditEntry) error {
+	insSQL := `
+	INSERT INTO audit(
+		Time,
+		Actor,
+		IP,
+		Action,
+		Subdomain,
+		OldValue,
+		NewValue,
+		TenantID)
+		values($1, $2, $3, $4, $5, $6, $7, $8)`
+	if Config.Database.Engine == "sqlite3" {
+		insSQL = getSQLiteStmt(insSQL)
+	}
+	_, err := tx.Exec(insSQL, time.Now().Unix(), e.Actor, e.IP, e.Action, e.Subdomain, e.OldValue, e.NewValue, e.TenantID)
+	return err
+}
+
+// webGetAudit returns a page of the audit log, the route is wrapped in AdminAuth. Tenant administrators
+// only see the entries of their tenant. The cursor for the next page is sent in the X-Next-Cursor header.
+func webGetAudit(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	params := r.URL.Query()
+	q := AuditQuery{
+		Actor:     params.Get("actor"),
+		IP:        params.Get("ip"),
+		Action:    params.Get("action"),
+		Subdomain: params.Get("subdomain"),
+		TenantID:  params.Get("tenant"),
+		Limit:     defaultAuditLimit,
+	}
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	if !actor.isSuperadmin() {
+		q.TenantID = actor.Tenant
+	}
+	var err error
+	for name, target := range map[string]*int64{"since": &q.Since, "until": &q.Until, "cursor": &q.Cursor} {
+		if v := params.Get(name); v != "" {
+			*target, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || *target < 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write(jsonError("invalid_" + name))
+				return
+			}
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 1 || q.Limit > maxAuditLimit {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(jsonError("invalid_limit"))
+			return
+		}
+	}
+
+	// One more than asked for tells if there is a next page
+	limit := q.Limit
+	q.Limit++
+	entries, err := DB.GetAuditLog(q)
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error fetching audit log")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		w.Header().Set("X-Next-Cursor", strconv.FormatInt(entries[limit-1].ID, 10))
+	}
+	resp, err := json.Marshal(entries)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	log "github.com/sirupsen/logrus"
@@ -16,12 +20,19 @@ type key int
 // ACMETxtKey is a context key for ACMETxt struct
 const ACMETxtKey key = 0
 
+// ActorKey is a context key for the Actor struct of an authenticated caller
+const ActorKey key = 1
+
+// Bcrypt hash compared against when the user does not exist and no hash of the configured algorithm is available, to protect against timed side channel
+const dummyHash = "$2a$10$8JEFVNYYhLoBysjAxe2yBuXrkDojBQBkVpXEQgyQyjn43SvJ4vL36"
+
 // Auth middleware for update request
 func Auth(update httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 		postData := ACMETxt{}
 		userOK := false
-		user, err := getUserFromRequest(r)
+		// Keys in the grace period after a rotation are only good for updating the TXT records
+		user, _, err := getUserFromRequest(r)
 		if err == nil {
 			if updateAllowedFromIP(r, user) {
 				dec := json.NewDecoder(r.Body)
@@ -44,6 +55,7 @@ func Auth(update httprouter.Handle) httprouter.Handle {
 			// Set user info to the decoded ACMETxt object
 			postData.Username = user.Username
 			postData.Password = user.Password
+			postData.TenantID = user.TenantID
 			// Set the ACMETxt struct to context to pull in from update function
 			ctx := context.WithValue(r.Context(), ACMETxtKey, postData)
 			update(w, r.WithContext(ctx), p)
@@ -55,39 +67,255 @@ func Auth(update httprouter.Handle) httprouter.Handle {
 	}
 }
 
-func getUserFromRequest(r *http.Request) (ACMETxt, error) {
+// AdminAuth middleware for administrative requests
+func AdminAuth(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		actor, err := getAdminFromRequest(r)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Admin authentication failed")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write(jsonError("unauthorized"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), ActorKey, actor)
+		handle(w, r.WithContext(ctx), p)
+	}
+}
+
+// SuperadminAuth middleware for administrative requests concerning all tenants
+func SuperadminAuth(handle httprouter.Handle) httprouter.Handle {
+	return AdminAuth(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		actor, _ := r.Context().Value(ActorKey).(Actor)
+		if !actor.isSuperadmin() {
+			log.WithFields(log.Fields{"admin": actor.Admin, "tenant": actor.Tenant, "path": r.URL.Path}).Error("Tenant administrator not allowed")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write(jsonError("forbidden"))
+			return
+		}
+		handle(w, r, p)
+	})
+}
+
+// ActorAuth middleware for requests that can be made either by the owner of a record or by an administrator
+func ActorAuth(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		actor, err := getActorFromRequest(r)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Authentication failed")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write(jsonError("unauthorized"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), ActorKey, actor)
+		handle(w, r.WithContext(ctx), p)
+	}
+}
+
+// getActorFromRequest authenticates the request with admin credentials if the Authorization header
+// is set, and with the X-Api-User and X-Api-Key credentials of a record otherwise
+func getActorFromRequest(r *http.Request) (Actor, error) {
+	if r.Header.Get("Authorization") != "" {
+		return getAdminFromRequest(r)
+	}
+	user, grace, err := getUserFromRequest(r)
+	if err != nil {
+		return Actor{}, err
+	}
+	if grace {
+		return Actor{}, fmt.Errorf("Key in grace period after rotation used for user %s", user.Username.String())
+	}
+	if !updateAllowedFromIP(r, user) {
+		return Actor{}, fmt.Errorf("Request not allowed from IP for user %s", user.Username.String())
+	}
+	return Actor{Username: user.Username, Subdomain: user.Subdomain, Tenant: user.TenantID, IP: getClientIP(r)}, nil
+}
+
+// getAdminFromRequest checks the request for a bearer token or basic auth credentials configured in the
+// admin section, which make the caller a superadministrator, or for the admin token of a tenant
+func getAdminFromRequest(r *http.Request) (Actor, error) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = strings.TrimSpace(token)
+		for i, t := range Config.Admin.Tokens {
+			if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return Actor{Admin: fmt.Sprintf("token%d", i), IP: getClientIP(r)}, nil
+			}
+		}
+		if token != "" {
+			if tenant, err := DB.GetTenantByToken(token); err == nil {
+				return Actor{Admin: tenant.Name, Tenant: tenant.ID, IP: getClientIP(r)}, nil
+			}
+		}
+		return Actor{}, errors.New("Invalid admin token")
+	}
+	if uname, passwd, ok := r.BasicAuth(); ok {
+		return getBasicAuthAdmin(uname, passwd, getClientIP(r))
+	}
+	return Actor{}, errors.New("No admin credentials")
+}
+
+// getBasicAuthAdmin checks the basic auth credentials against the admin users. Failed attempts are counted
+// per client IP and per configured admin username and lock them out like the X-Api-Key attempts.
+func getBasicAuthAdmin(uname string, passwd string, ip string) (Actor, error) {
+	keys := []lockoutKey{{kind: "ip", value: ip}}
+	var admin adminuser
+	known := false
+	for _, u := range Config.Admin.Users {
+		if u.Username == uname {
+			admin, known = u, true
+			keys = append(keys, lockoutKey{kind: "admin", value: uname})
+			break
+		}
+	}
+	if wait := lockouts.lockedFor(time.Now(), keys...); wait > 0 {
+		return Actor{}, fmt.Errorf("Locked out after failed attempts, admin %s from %s for %s", uname, ip, wait.Round(time.Second))
+	}
+	if !known {
+		correctPassword(passwd, dummyPasswordHash())
+		lockouts.fail(time.Now(), keys...)
+		return Actor{}, fmt.Errorf("Invalid admin user %s", uname)
+	}
+	if !correctPassword(passwd, admin.Password) {
+		lockouts.fail(time.Now(), keys...)
+		return Actor{}, fmt.Errorf("Invalid password for admin %s", uname)
+	}
+	lockouts.succeed(keys[1:]...)
+	lockouts.decay(keys[0])
+	return Actor{Admin: admin.Username, IP: ip}, nil
+}
+
+// getUserFromRequest authenticates the X-Api-User and X-Api-Key credentials of a record, failed attempts
+// are counted per username and per client IP and lock them out after the configured threshold. The returned
+// flag is set if the key is a previous one still in its grace period after a rotation.
+func getUserFromRequest(r *http.Request) (ACMETxt, bool, error) {
 	uname := r.Header.Get("X-Api-User")
 	passwd := r.Header.Get("X-Api-Key")
+	keys := []lockoutKey{{kind: "ip", value: getClientIP(r)}}
+	if username, err := getValidUsername(uname); err == nil {
+		keys = append(keys, lockoutKey{kind: "user", value: username.String()})
+	}
+	if wait := lockouts.lockedFor(time.Now(), keys...); wait > 0 {
+		authFailures.WithLabelValues(authLockedOut).Inc()
+		return ACMETxt{}, false, fmt.Errorf("Locked out after failed attempts, user %s from %s for %s", uname, keys[0].value, wait.Round(time.Second))
+	}
+	user, grace, err := getUserWithCredentials(uname, passwd)
+	if err != nil {
+		lockouts.fail(time.Now(), keys...)
+		return user, false, err
+	}
+	// A valid key from the IP does not vouch for other users tried from it, it only takes back one failure of
+	// the IP, so that clients sharing it do not lock each other out
+	lockouts.succeed(keys[1:]...)
+	lockouts.decay(keys[0])
+	return user, grace, nil
+}
+
+func getUserWithCredentials(uname string, passwd string) (ACMETxt, bool, error) {
 	username, err := getValidUsername(uname)
 	if err != nil {
-		return ACMETxt{}, fmt.Errorf("Invalid username: %s: %s", uname, err.Error())
+		authFailures.WithLabelValues(authInvalidUsername).Inc()
+		return ACMETxt{}, false, fmt.Errorf("Invalid username: %s: %s", uname, err.Error())
 	}
 	if validKey(passwd) {
+		if user, ok := credCache.get(username, passwd, time.Now()); ok {
+			return user, false, nil
+		}
+		generation := credCache.currentGeneration()
 		dbuser, err := DB.GetByUsername(username)
 		if err != nil {
 			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get user")
 			// To protect against timed side channel (never gonna give you up)
-			correctPassword(passwd, "$2a$10$8JEFVNYYhLoBysjAxe2yBuXrkDojBQBkVpXEQgyQyjn43SvJ4vL36")
-
-			return ACMETxt{}, fmt.Errorf("Invalid username: %s", uname)
+			correctPassword(passwd, dummyPasswordHash())
+			authFailures.WithLabelValues(authUnknownUser).Inc()
+			return ACMETxt{}, false, fmt.Errorf("Invalid username: %s", uname)
 		}
 		if correctPassword(passwd, dbuser.Password) {
-			return dbuser, nil
+			upgradePasswordHash(dbuser, passwd)
+			// Passwords in their grace period are not cached, so they expire in time
+			credCache.put(dbuser, passwd, generation, time.Now())
+			return dbuser, false, nil
+		}
+		// Previous passwords are accepted during the grace period after a rotation
+		rotated, err := DB.GetRotatedPasswords(username)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Error while trying to get rotated passwords")
+		}
+		for _, hash := range rotated {
+			if correctPassword(passwd, hash) {
+				return dbuser, true, nil
+			}
 		}
-		return ACMETxt{}, fmt.Errorf("Invalid password for user %s", uname)
+		authFailures.WithLabelValues(authInvalidPassword).Inc()
+		return ACMETxt{}, false, fmt.Errorf("Invalid password for user %s", uname)
 	}
-	return ACMETxt{}, fmt.Errorf("Invalid key for user %s", uname)
+	authFailures.WithLabelValues(authInvalidKey).Inc()
+	return ACMETxt{}, false, fmt.Errorf("Invalid key for user %s", uname)
 }
 
-func updateAllowedFromIP(r *http.Request, user ACMETxt) bool {
-	if Config.API.UseHeader {
-		ips := getIPListFromHeader(r.Header.Get(Config.API.HeaderName))
-		return user.allowedFromList(ips)
+// upgradePasswordHash replaces the stored hash of the user if it was made with other than the configured
+// algorithm or parameters. Failures are only logged, the old hash keeps working.
+func upgradePasswordHash(user ACMETxt, passwd string) {
+	if !needsRehash(user.Password) {
+		return
+	}
+	newHash, err := hashPassword(passwd)
+	if err == nil {
+		err = DB.UpdatePasswordHash(user.Username, user.Password, newHash)
 	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "user": user.Username.String()}).Error("Error while upgrading password hash")
+		return
+	}
+	log.WithFields(log.Fields{"user": user.Username.String()}).Info("Upgraded password hash")
+}
+
+func updateAllowedFromIP(r *http.Request, user ACMETxt) bool {
+	return user.allowedFrom(getClientIP(r))
+}
+
+// getClientIP returns the IP address of the client. The configured header is only honored for requests
+// coming from a trusted proxy, and the right-most hop not belonging to the trusted proxies is used, as
+// everything left of it may have been sent by the client itself. If that hop is not an IP address, eg.
+// "unknown", no client IP is returned rather than the value or a hop further left.
+func getClientIP(r *http.Request) string {
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error(), "remoteaddr": r.RemoteAddr}).Error("Error while parsing remote address")
-		host = ""
+		return ""
+	}
+	if !Config.API.UseHeader || !trustedProxy(host) {
+		return host
+	}
+	ips := getIPListFromHeader(r.Header.Get(Config.API.HeaderName))
+	for i := len(ips) - 1; i >= 0; i-- {
+		if !trustedProxy(ips[i]) {
+			if net.ParseIP(sanitizeIPv6addr(ips[i])) == nil {
+				log.WithFields(log.Fields{"header": Config.API.HeaderName, "value": ips[i], "proxy": host}).Warning("Invalid client address in header")
+				return ""
+			}
+			return ips[i]
+		}
+	}
+	// Every hop is a proxy of our own, the left-most one is the closest to the client
+	if len(ips) > 0 {
+		return ips[0]
+	}
+	return host
+}
+
+// trustedProxy checks if the address belongs to the configured trusted proxies
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(sanitizeIPv6addr(addr))
+	if ip == nil {
+		return false
+	}
+	for _, v := range Config.API.TrustedProxies {
+		_, vnet, err := net.ParseCIDR(sanitizeIPv6addr(v))
+		if err == nil && vnet.Contains(ip) {
+			return true
+		}
 	}
-	return user.allowedFrom(host)
+	return false
 }
@@ -2,7 +2,10 @@ package main
 
 import (
 	"net/http"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestUpdateAllowedFromIP(t *testing.T) {
@@ -32,3 +35,106 @@ func TestUpdateAllowedFromIP(t *testing.T) {
 		}
 	}
 }
+
+func TestGetClientIP(t *testing.T) {
+	Config.API.HeaderName = "X-Forwarded-For"
+	Config.API.TrustedProxies = []string{"192.168.1.0/24", "::1/128"}
+	defer func() {
+		Config.API.UseHeader = false
+		Config.API.TrustedProxies = nil
+	}()
+	for i, test := range []struct {
+		useHeader  bool
+		remoteaddr string
+		header     string
+		expected   string
+	}{
+		{false, "192.168.1.2:1234", "10.0.0.1", "192.168.1.2"},
+		{false, "[::1]:1234", "", "::1"},
+		{false, "invalid", "", ""},
+		{true, "192.168.1.2:1234", "10.0.0.1", "10.0.0.1"},
+		{true, "[::1]:1234", "10.0.0.1", "10.0.0.1"},
+		{true, "192.168.1.2:1234", "10.0.0.1, 10.0.0.2", "10.0.0.2"},
+		{true, "192.168.1.2:1234", "10.0.0.1, 10.0.0.2, 192.168.1.3", "10.0.0.2"},
+		{true, "192.168.1.2:1234", "192.168.1.4, 192.168.1.3", "192.168.1.4"},
+		{true, "192.168.1.2:1234", "", "192.168.1.2"},
+		{true, "10.0.0.5:1234", "192.168.1.2", "10.0.0.5"},
+		{true, "192.168.1.2:1234", "unknown", ""},
+		{true, "192.168.1.2:1234", "10.0.0.1, unknown", ""},
+		{true, "192.168.1.2:1234", "unknown, 2001:db8::1, 192.168.1.3", "2001:db8::1"},
+	} {
+		Config.API.UseHeader = test.useHeader
+		r := http.Request{RemoteAddr: test.remoteaddr, Header: http.Header{}}
+		if test.header != "" {
+			r.Header.Set("X-Forwarded-For", test.header)
+		}
+		if ret := getClientIP(&r); ret != test.expected {
+			t.Errorf("Test %d: Expected [%s], got [%s]", i, test.expected, ret)
+		}
+	}
+}
+
+func TestBasicAuthAdminLockout(t *testing.T) {
+	adminHash, _ := bcrypt.GenerateFromPassword([]byte("adminpass"), bcrypt.MinCost)
+	Config.Admin = adminconfig{Users: []adminuser{{Username: "admin", Password: string(adminHash)}}}
+	Config.Lockout = lockoutconfig{Threshold: 2, BaseSeconds: 60, MaxMinutes: 60}
+	defer func() {
+		Config.Admin = adminconfig{}
+		Config.Lockout = lockoutconfig{}
+		lockouts = newLockoutTracker()
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := getBasicAuthAdmin("admin", "wrongpass", "10.0.0.1"); err == nil {
+			t.Errorf("Expected wrong password to fail")
+		}
+	}
+	// Locked out even with the correct password, from any IP
+	if _, err := getBasicAuthAdmin("admin", "adminpass", "10.0.0.2"); err == nil || !strings.Contains(err.Error(), "Locked out") {
+		t.Errorf("Expected admin to be locked out, got [%v]", err)
+	}
+	if !lockouts.clear(lockoutKey{kind: "admin", value: "admin"}) {
+		t.Errorf("Expected admin lockout entry")
+	}
+	if _, err := getBasicAuthAdmin("admin", "adminpass", "10.0.0.1"); err == nil {
+		t.Errorf("Expected the guessing IP to stay locked out")
+	}
+	actor, err := getBasicAuthAdmin("admin", "adminpass", "10.0.0.2")
+	if err != nil || actor.Admin != "admin" {
+		t.Errorf("Expected admin actor, got [%v] [%v]", actor, err)
+	}
+	// Unknown admin users only count against the IP
+	_, _ = getBasicAuthAdmin("nobody", "wrongpass", "10.0.0.3")
+	for _, lo := range lockouts.list() {
+		if lo.Value == "nobody" {
+			t.Errorf("Expected no entry for unknown admin user, got [%v]", lo)
+		}
+	}
+}
+
+func TestUpgradePasswordHash(t *testing.T) {
+	Config.Hashing = hashconfig{Algorithm: "bcrypt", BcryptCost: 4}
+	defer func() { Config.Hashing = hashconfig{}.withDefaults() }()
+	user, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Fatalf("Could not create new user, got error [%v]", err)
+	}
+	r := http.Request{RemoteAddr: "127.0.0.1:1234", Header: http.Header{}}
+	r.Header.Set("X-Api-User", user.Username.String())
+	r.Header.Set("X-Api-Key", user.Password)
+
+	Config.Hashing = hashconfig{Algorithm: "argon2id", Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	if _, _, err = getUserFromRequest(&r); err != nil {
+		t.Fatalf("Expected bcrypt hash to keep working, got error [%v]", err)
+	}
+	stored, _ := DB.GetByUsername(user.Username)
+	if !strings.HasPrefix(stored.Password, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Expected hash to be upgraded to argon2id, got [%s]", stored.Password)
+	}
+	if _, _, err = getUserFromRequest(&r); err != nil {
+		t.Errorf("Expected upgraded hash to work, got error [%v]", err)
+	}
+	entries, _ := DB.GetAuditLog(AuditQuery{Action: auditRehashPassword, Subdomain: user.Subdomain, Limit: 10})
+	if len(entries) != 1 || entries[0].Actor != auditSystemActor || entries[0].OldValue != "bcrypt cost=4" || entries[0].NewValue != "argon2id m=1024,t=1,p=1" {
+		t.Errorf("Expected one audit entry for the upgraded hash, got %v", entries)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// credCache holds recent successful API key verifications
+var credCache = newCredentialCache()
+
+// credentialCache remembers verified username and key pairs for a short time to skip the password
+// hash comparison and the database lookup. Keys are only stored as HMAC with a random per process secret.
+// Invalidations only reach the cache of this process, other instances keep their entries until they expire.
+type credentialCache struct {
+	Mutex   sync.Mutex
+	secret  []byte
+	entries map[uuid.UUID]credentialCacheEntry
+	// generation changes on every invalidation, so that verifications that started before it are not cached
+	generation uint64
+}
+
+type credentialCacheEntry struct {
+	mac     []byte
+	user    ACMETxt
+	expires time.Time
+}
+
+func newCredentialCache() *credentialCache {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return &credentialCache{secret: secret, entries: make(map[uuid.UUID]credentialCacheEntry)}
+}
+
+func (c *credentialCache) mac(username uuid.UUID, key string) []byte {
+	h := hmac.New(sha256.New, c.secret)
+	_, _ = h.Write([]byte(username.String()))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+// get returns the cached user if the key was verified for the username within the TTL
+func (c *credentialCache) get(username uuid.UUID, key string, now time.Time) (ACMETxt, bool) {
+	if Config.CredentialCache.TTLSeconds < 1 {
+		return ACMETxt{}, false
+	}
+	mac := c.mac(username, key)
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	e, ok := c.entries[username]
+	if !ok || now.After(e.expires) || !hmac.Equal(e.mac, mac) {
+		return ACMETxt{}, false
+	}
+	return e.user, true
+}
+
+// currentGeneration returns the generation to pass to put for a verification starting now
+func (c *credentialCache) currentGeneration() uint64 {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.generation
+}
+
+// put caches a successful verification of the key of user, unless the cache was invalidated since generation
+func (c *credentialCache) put(user ACMETxt, key string, generation uint64, now time.Time) {
+	cfg := Config.CredentialCache
+	if cfg.TTLSeconds < 1 || cfg.Size < 1 {
+		return
+	}
+	mac := c.mac(user.Username, key)
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if _, ok := c.entries[user.Username]; !ok && len(c.entries) >= cfg.Size {
+		for u, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, u)
+			}
+		}
+		// Still full, make room by dropping an arbitrary entry
+		for u := range c.entries {
+			if len(c.entries) < cfg.Size {
+				break
+			}
+			delete(c.entries, u)
+		}
+	}
+	c.entries[user.Username] = credentialCacheEntry{
+		mac:     mac,
+		user:    user,
+		expires: now.Add(time.Duration(cfg.TTLSeconds) * time.Second),
+	}
+}
+
+// invalidate drops the cached verifications of the record with the subdomain
+func (c *credentialCache) invalidate(subdomain string) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.generation++
+	for u, e := range c.entries {
+		if e.user.Subdomain == subdomain {
+			delete(c.entries, u)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCredentialCache(t *testing.T) {
+	Config.CredentialCache = credentialcacheconfig{TTLSeconds: 60, Size: 2}
+	defer func() { Config.CredentialCache = credentialcacheconfig{} }()
+	c := newCredentialCache()
+	now := time.Now()
+	user := newACMETxt()
+
+	c.put(user, user.Password, c.currentGeneration(), now)
+	if _, ok := c.get(user.Username, user.Password, now); !ok {
+		t.Errorf("Expected cached credential to be found")
+	}
+	if _, ok := c.get(user.Username, "wrong", now); ok {
+		t.Errorf("Expected wrong key not to be found")
+	}
+	if _, ok := c.get(user.Username, user.Password, now.Add(61*time.Second)); ok {
+		t.Errorf("Expected expired credential not to be found")
+	}
+	if bytes.Contains(c.entries[user.Username].mac, []byte(user.Password)) {
+		t.Errorf("Key should not be stored in plaintext")
+	}
+
+	c.invalidate(user.Subdomain)
+	if _, ok := c.get(user.Username, user.Password, now); ok {
+		t.Errorf("Expected invalidated credential not to be found")
+	}
+
+	// Verifications started before an invalidation are not cached
+	generation := c.currentGeneration()
+	c.invalidate("other")
+	c.put(user, user.Password, generation, now)
+	if _, ok := c.get(user.Username, user.Password, now); ok {
+		t.Errorf("Expected stale verification not to be cached")
+	}
+
+	// Size is bounded
+	for i := 0; i < 5; i++ {
+		u := newACMETxt()
+		c.put(u, u.Password, c.currentGeneration(), now)
+	}
+	if len(c.entries) != 2 {
+		t.Errorf("Expected [2] cached credentials, got [%d]", len(c.entries))
+	}
+
+	Config.CredentialCache.TTLSeconds = 0
+	c.put(user, user.Password, c.currentGeneration(), now)
+	if _, ok := c.get(user.Username, user.Password, now); ok {
+		t.Errorf("Expected disabled cache not to return credentials")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -14,11 +15,28 @@ import (
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // DBVersion shows the database version this code uses. This is used for update checks.
-var DBVersion = 2
+var DBVersion = 6
+
+// defaultTXTSlots is the number of TXT values kept for a record if not configured otherwise
+const defaultTXTSlots = 2
+
+// errNoRecord is returned when no record exists for the requested subdomain
+var errNoRecord = errors.New("no such record")
+
+// errNotOwner is returned when the caller is not allowed to modify the requested record
+var errNotOwner = errors.New("record not owned by caller")
+
+// errNoTenant is returned when a tenant given for a new record or registration token does not exist
+var errNoTenant = errors.New("no such tenant")
+
+// errTenantInUse is returned when deleting a tenant that still has records
+var errTenantInUse = errors.New("tenant has records")
+
+// errInvalidRegToken is returned when a registration token is unknown, expired, used up or does not match the domain name
+var errInvalidRegToken = errors.New("invalid registration token")
 
 var acmeTable = `
 	CREATE TABLE IF NOT EXISTS acmedns(
@@ -34,9 +52,75 @@ var userTable = `
 		AllowFrom TEXT,
 		DomainName TEXT DEFAULT '',
 		CreatedAt INT DEFAULT 0,
-		UpdatedAt INT DEFAULT 0
+		UpdatedAt INT DEFAULT 0,
+		TXTSlots INT DEFAULT 2,
+		RegToken TEXT DEFAULT '',
+		TenantID TEXT DEFAULT '',
+		Note TEXT DEFAULT '',
+		Owner TEXT DEFAULT ''
     );`
 
+var labelTable = `
+	CREATE TABLE IF NOT EXISTS labels(
+		Username TEXT NOT NULL,
+		Name TEXT NOT NULL,
+		Value TEXT NOT NULL DEFAULT '',
+		UNIQUE(Username, Name)
+	);`
+
+var rotatedTable = `
+	CREATE TABLE IF NOT EXISTS rotated(
+		Username TEXT NOT NULL,
+		Password TEXT NOT NULL,
+		Expires INT NOT NULL
+	);`
+
+var regTokenTable = `
+	CREATE TABLE IF NOT EXISTS regtokens(
+		ID TEXT UNIQUE NOT NULL PRIMARY KEY,
+		Token TEXT UNIQUE NOT NULL,
+		DomainPattern TEXT DEFAULT '',
+		MaxUses INT DEFAULT 1,
+		Uses INT DEFAULT 0,
+		Expires INT DEFAULT 0,
+		CreatedAt INT DEFAULT 0,
+		TenantID TEXT DEFAULT ''
+	);`
+
+var tenantTable = `
+	CREATE TABLE IF NOT EXISTS tenants(
+		ID TEXT UNIQUE NOT NULL PRIMARY KEY,
+		Name TEXT UNIQUE NOT NULL,
+		Token TEXT UNIQUE NOT NULL,
+		CreatedAt INT DEFAULT 0
+	);`
+
+var auditTable = `
+	CREATE TABLE IF NOT EXISTS audit(
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		Time INT NOT NULL,
+		Actor TEXT NOT NULL,
+		IP TEXT DEFAULT '',
+		Action TEXT NOT NULL,
+		Subdomain TEXT DEFAULT '',
+		OldValue TEXT DEFAULT '',
+		NewValue TEXT DEFAULT '',
+		TenantID TEXT DEFAULT ''
+	);`
+
+var auditTablePG = `
+	CREATE TABLE IF NOT EXISTS audit(
+		ID BIGSERIAL PRIMARY KEY,
+		Time INT NOT NULL,
+		Actor TEXT NOT NULL,
+		IP TEXT DEFAULT '',
+		Action TEXT NOT NULL,
+		Subdomain TEXT DEFAULT '',
+		OldValue TEXT DEFAULT '',
+		NewValue TEXT DEFAULT '',
+		TenantID TEXT DEFAULT ''
+	);`
+
 var txtTable = `
     CREATE TABLE IF NOT EXISTS txt(
 		Subdomain TEXT NOT NULL,
@@ -54,7 +138,7 @@ var txtTablePG = `
 
 // getSQLiteStmt replaces all PostgreSQL prepared statement placeholders (eg. $1, $2) with SQLite variant "?"
 func getSQLiteStmt(s string) string {
-	re, _ := regexp.Compile(`\$[0-9]`)
+	re, _ := regexp.Compile(`\$[0-9]+`)
 	return re.ReplaceAllString(s, "?")
 }
 
@@ -74,10 +158,16 @@ func (d *acmedb) Init(engine string, connection string) error {
 	}
 	_, _ = d.DB.Exec(acmeTable)
 	_, _ = d.DB.Exec(userTable)
+	_, _ = d.DB.Exec(rotatedTable)
+	_, _ = d.DB.Exec(regTokenTable)
+	_, _ = d.DB.Exec(tenantTable)
+	_, _ = d.DB.Exec(labelTable)
 	if Config.Database.Engine == "sqlite3" {
 		_, _ = d.DB.Exec(txtTable)
+		_, _ = d.DB.Exec(auditTable)
 	} else {
 		_, _ = d.DB.Exec(txtTablePG)
+		_, _ = d.DB.Exec(auditTablePG)
 	}
 	// If everything is fine, handle db upgrade tasks
 	if err == nil {
@@ -115,7 +205,35 @@ func (d *acmedb) handleDBUpgrades(version int) error {
 		version = 1
 	}
 	if version == 1 {
-		return d.handleDBUpgradeTo2()
+		err := d.handleDBUpgradeTo2()
+		if err != nil {
+			return err
+		}
+		version = 2
+	}
+	if version == 2 {
+		err := d.handleDBUpgradeTo3()
+		if err != nil {
+			return err
+		}
+		version = 3
+	}
+	if version == 3 {
+		err := d.handleDBUpgradeTo4()
+		if err != nil {
+			return err
+		}
+		version = 4
+	}
+	if version == 4 {
+		err := d.handleDBUpgradeTo5()
+		if err != nil {
+			return err
+		}
+		version = 5
+	}
+	if version == 5 {
+		return d.handleDBUpgradeTo6()
 	}
 	return nil
 }
@@ -156,7 +274,7 @@ func (d *acmedb) handleDBUpgradeTo1() error {
 	for _, subdomain := range subdomains {
 		if subdomain != "" {
 			// Insert two rows for each subdomain to txt table
-			err = d.NewTXTValuesInTransaction(tx, subdomain)
+			err = d.NewTXTValuesInTransaction(tx, subdomain, defaultTXTSlots)
 			if err != nil {
 				log.WithFields(log.Fields{"error": err.Error()}).Error("Error in DB upgrade while inserting values")
 				return err
@@ -251,20 +369,162 @@ func (d *acmedb) handleDBUpgradeTo2() error {
 	return nil
 }
 
-// Create two rows for subdomain to the txt table
-func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string) error {
-	var err error
-	instr := fmt.Sprintf("INSERT INTO txt (Subdomain, LastUpdate) values('%s', 0)", subdomain)
-	_, _ = tx.Exec(instr)
-	_, _ = tx.Exec(instr)
+func (d *acmedb) handleDBUpgradeTo3() error {
+	log.Info("Upgrading database to version 3: Adding TXTSlots column")
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	// Existing records were created with two TXT rows each
+	err = addColumnInTransaction(tx, "records", "TXTSlots", "INT DEFAULT 2")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error adding TXTSlots column")
+		return err
+	}
+	_, err = tx.Exec("UPDATE acmedns SET Value='3' WHERE Name='db_version'")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error updating database version")
+		return err
+	}
+	log.Info("Database upgraded to version 3 successfully")
+	return nil
+}
+
+func (d *acmedb) handleDBUpgradeTo4() error {
+	log.Info("Upgrading database to version 4: Adding RegToken column")
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	err = addColumnInTransaction(tx, "records", "RegToken", "TEXT DEFAULT ''")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error adding RegToken column")
+		return err
+	}
+	_, err = tx.Exec("UPDATE acmedns SET Value='4' WHERE Name='db_version'")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error updating database version")
+		return err
+	}
+	log.Info("Database upgraded to version 4 successfully")
+	return nil
+}
+
+func (d *acmedb) handleDBUpgradeTo5() error {
+	log.Info("Upgrading database to version 5: Adding TenantID columns")
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	for _, table := range []string{"records", "regtokens", "audit"} {
+		err = addColumnInTransaction(tx, table, "TenantID", "TEXT DEFAULT ''")
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "table": table}).Error("Error adding TenantID column")
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE acmedns SET Value='5' WHERE Name='db_version'")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error updating database version")
+		return err
+	}
+	log.Info("Database upgraded to version 5 successfully")
+	return nil
+}
+
+func (d *acmedb) handleDBUpgradeTo6() error {
+	log.Info("Upgrading database to version 6: Adding Note and Owner columns")
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	for _, column := range []string{"Note", "Owner"} {
+		err = addColumnInTransaction(tx, "records", column, "TEXT DEFAULT ''")
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "column": column}).Error("Error adding column")
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE acmedns SET Value='6' WHERE Name='db_version'")
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error updating database version")
+		return err
+	}
+	log.Info("Database upgraded to version 6 successfully")
+	return nil
+}
+
+// addColumnInTransaction adds a column to a table unless it already exists
+func addColumnInTransaction(tx *sql.Tx, table string, column string, definition string) error {
+	if Config.Database.Engine == "sqlite3" {
+		// SQLite doesn't support ALTER TABLE ADD COLUMN IF NOT EXISTS
+		var count int
+		err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name='%s'", table, column)).Scan(&count)
+		if err == nil && count > 0 {
+			return nil
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return err
+		}
+		return nil
+	}
+	_, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column, definition))
 	return err
 }
 
+// Create the given number of rows for subdomain to the txt table
+func (d *acmedb) NewTXTValuesInTransaction(tx *sql.Tx, subdomain string, slots int) error {
+	insSQL := "INSERT INTO txt (Subdomain, LastUpdate) values($1, 0)"
+	if Config.Database.Engine == "sqlite3" {
+		insSQL = getSQLiteStmt(insSQL)
+	}
+	for i := 0; i < slots; i++ {
+		if _, err := tx.Exec(insSQL, subdomain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *acmedb) Register(afrom cidrslice) (ACMETxt, error) {
-	return d.RegisterWithName(afrom, "")
+	return d.RegisterRecord(registration{AllowFrom: afrom})
 }
 
-func (d *acmedb) RegisterWithName(afrom cidrslice, domainName string) (ACMETxt, error) {
+// RegisterRecord creates a new record with random credentials using the options in reg
+func (d *acmedb) RegisterRecord(reg registration) (ACMETxt, error) {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
 	var err error
@@ -278,11 +538,48 @@ func (d *acmedb) RegisterWithName(afrom cidrslice, domainName string) (ACMETxt,
 		_ = tx.Commit()
 	}()
 	a := newACMETxt()
-	a.AllowFrom = cidrslice(afrom.ValidEntries())
-	a.DomainName = domainName
+	if reg.Subdomain != "" {
+		a.Subdomain = reg.Subdomain
+	}
+	a.AllowFrom = cidrslice(reg.AllowFrom.ValidEntries())
+	a.DomainName = reg.DomainName
+	a.TXTSlots = reg.TXTSlots
+	if a.TXTSlots < 1 {
+		a.TXTSlots = Config.API.TXTSlots
+	}
+	if a.TXTSlots < 1 {
+		a.TXTSlots = defaultTXTSlots
+	}
 	a.CreatedAt = time.Now().Unix()
 	a.UpdatedAt = time.Now().Unix()
-	passwordHash, err := bcrypt.GenerateFromPassword([]byte(a.Password), 10)
+	a.TenantID = reg.TenantID
+	a.Labels = reg.Labels
+	a.Note = reg.Note
+	a.Owner = reg.Owner
+	if reg.RegToken != "" {
+		var tokenTenant string
+		a.RegToken, tokenTenant, err = d.useRegTokenInTransaction(tx, reg.RegToken, a.DomainName)
+		if err != nil {
+			return a, err
+		}
+		// Records registered with a token belong to the tenant of the token
+		if a.TenantID == "" {
+			a.TenantID = tokenTenant
+		} else if tokenTenant != a.TenantID {
+			err = errInvalidRegToken
+			return a, err
+		}
+	}
+	if a.TenantID != "" {
+		err = tenantExistsInTransaction(tx, a.TenantID)
+		if err != nil {
+			return a, err
+		}
+	}
+	passwordHash, err := hashPassword(a.Password)
+	if err != nil {
+		return a, err
+	}
 	regSQL := `
     INSERT INTO records(
         Username,
@@ -291,8 +588,13 @@ func (d *acmedb) RegisterWithName(afrom cidrslice, domainName string) (ACMETxt,
 		AllowFrom,
 		DomainName,
 		CreatedAt,
-		UpdatedAt) 
-        values($1, $2, $3, $4, $5, $6, $7)`
+		UpdatedAt,
+		TXTSlots,
+		RegToken,
+		TenantID,
+		Note,
+		Owner)
+        values($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
 	if Config.Database.Engine == "sqlite3" {
 		regSQL = getSQLiteStmt(regSQL)
 	}
@@ -302,122 +604,856 @@ func (d *acmedb) RegisterWithName(afrom cidrslice, domainName string) (ACMETxt,
 		return a, errors.New("SQL error")
 	}
 	defer sm.Close()
-	_, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, a.AllowFrom.JSON(), a.DomainName, a.CreatedAt, a.UpdatedAt)
+	_, err = sm.Exec(a.Username.String(), passwordHash, a.Subdomain, a.AllowFrom.JSON(), a.DomainName, a.CreatedAt, a.UpdatedAt, a.TXTSlots, a.RegToken, a.TenantID, a.Note, a.Owner)
+	if reg.Subdomain != "" && isUniqueViolation(err) {
+		err = errSubdomainTaken
+	}
+	if err == nil {
+		err = setLabelsInTransaction(tx, a.Username.String(), a.Labels)
+	}
 	if err == nil {
-		err = d.NewTXTValuesInTransaction(tx, a.Subdomain)
+		err = d.NewTXTValuesInTransaction(tx, a.Subdomain, a.TXTSlots)
+	}
+	if err == nil {
+		err = writeAuditInTransaction(tx, reg.Actor, a.TenantID, auditRegister, a.Subdomain, "", a.DomainName)
 	}
 	return a, err
 }
 
-// UpdateDomainName updates the domain name for a given subdomain
-func (d *acmedb) UpdateDomainName(subdomain string, domainName string) error {
-	d.Mutex.Lock()
-	defer d.Mutex.Unlock()
-	
-	query := `UPDATE records SET DomainName = $1, UpdatedAt = $2 WHERE Subdomain = $3`
+// useRegTokenInTransaction checks that the registration token is valid for domainName, counts its use
+// and returns the ID and the tenant of the token
+func (d *acmedb) useRegTokenInTransaction(tx *sql.Tx, token string, domainName string) (string, string, error) {
+	var rt RegToken
+	getSQL := `
+	SELECT ID, DomainPattern, MaxUses, Uses, Expires, COALESCE(TenantID, '')
+	FROM regtokens
+	WHERE Token=$1 LIMIT 1
+	`
+	useSQL := `UPDATE regtokens SET Uses = Uses + 1 WHERE ID=$1 AND Uses < MaxUses`
 	if Config.Database.Engine == "sqlite3" {
-		query = getSQLiteStmt(query)
+		getSQL = getSQLiteStmt(getSQL)
+		useSQL = getSQLiteStmt(useSQL)
+	}
+	err := tx.QueryRow(getSQL, hashToken(token)).Scan(&rt.ID, &rt.DomainPattern, &rt.MaxUses, &rt.Uses, &rt.Expires, &rt.TenantID)
+	if err == sql.ErrNoRows {
+		return "", "", errInvalidRegToken
 	}
-	
-	_, err := d.DB.Exec(query, domainName, time.Now().Unix(), subdomain)
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	
-	return nil
+	if rt.Expires > 0 && rt.Expires < time.Now().Unix() {
+		return "", "", errInvalidRegToken
+	}
+	if !rt.matchesDomain(domainName) {
+		return "", "", errInvalidRegToken
+	}
+	// Checking the use count in the update keeps concurrent registrations from exceeding it
+	res, err := tx.Exec(useSQL, rt.ID)
+	if err != nil {
+		return "", "", err
+	}
+	used, err := res.RowsAffected()
+	if err != nil {
+		return "", "", err
+	}
+	if used == 0 {
+		return "", "", errInvalidRegToken
+	}
+	return rt.ID, rt.TenantID, nil
 }
 
-func (d *acmedb) GetAllDomains() ([]ACMETxt, error) {
+// NewRegToken creates a registration token with the options of rt and returns it with the plaintext token
+func (d *acmedb) NewRegToken(actor Actor, rt RegToken) (RegToken, error) {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
-	var results []ACMETxt
-	getSQL := `
-	SELECT Username, Password, Subdomain, AllowFrom, 
-	       COALESCE(DomainName, '') as DomainName,
-	       COALESCE(CreatedAt, 0) as CreatedAt,
-	       COALESCE(UpdatedAt, 0) as UpdatedAt
-	FROM records
-	`
-	rows, err := d.DB.Query(getSQL)
+	var err error
+	tx, err := d.DB.Begin()
 	if err != nil {
-		return results, err
+		return rt, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		txt := ACMETxt{}
-		afrom := ""
-		err = rows.Scan(&txt.Username, &txt.Password, &txt.Subdomain, &afrom, 
-			&txt.DomainName, &txt.CreatedAt, &txt.UpdatedAt)
+	// Rollback if errored, commit if not
+	defer func() {
 		if err != nil {
-			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in GetAllDomains")
-			return results, err
+			_ = tx.Rollback()
+			return
 		}
-		txt.AllowFrom.Unmarshal(afrom)
-		// Clear password hash for security
-		txt.Password = ""
-		// Add fulldomain
-		txt.Fulldomain = txt.Subdomain + "." + Config.General.Domain
-		results = append(results, txt)
+		_ = tx.Commit()
+	}()
+	if rt.TenantID != "" {
+		err = tenantExistsInTransaction(tx, rt.TenantID)
+		if err != nil {
+			return rt, err
+		}
+	}
+	rt.ID = uuid.New().String()
+	rt.Token = generatePassword(40)
+	rt.Uses = 0
+	rt.CreatedAt = time.Now().Unix()
+	insSQL := `
+	INSERT INTO regtokens(
+		ID,
+		Token,
+		DomainPattern,
+		MaxUses,
+		Uses,
+		Expires,
+		CreatedAt,
+		TenantID)
+		values($1, $2, $3, $4, $5, $6, $7, $8)`
+	if Config.Database.Engine == "sqlite3" {
+		insSQL = getSQLiteStmt(insSQL)
+	}
+	_, err = tx.Exec(insSQL, rt.ID, hashToken(rt.Token), rt.DomainPattern, rt.MaxUses, rt.Uses, rt.Expires, rt.CreatedAt, rt.TenantID)
+	if err != nil {
+		return rt, err
 	}
-	return results, nil
+	err = writeAuditInTransaction(tx, actor, rt.TenantID, auditCreateRegToken, "", "", rt.ID)
+	return rt, err
 }
 
-func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
+// GetRegTokens returns the registration tokens visible to the actor without the token values
+func (d *acmedb) GetRegTokens(actor Actor) ([]RegToken, error) {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
-	var results []ACMETxt
-	getSQL := `
-	SELECT Username, Password, Subdomain, AllowFrom
-	FROM records
-	WHERE Username=$1 LIMIT 1
-	`
+	var results []RegToken
+	getSQL := `SELECT ID, DomainPattern, MaxUses, Uses, Expires, CreatedAt, COALESCE(TenantID, '') FROM regtokens`
+	var args []interface{}
+	if !actor.isSuperadmin() {
+		getSQL += ` WHERE TenantID=$1`
+		args = append(args, actor.Tenant)
+	}
+	getSQL += ` ORDER BY CreatedAt`
 	if Config.Database.Engine == "sqlite3" {
 		getSQL = getSQLiteStmt(getSQL)
 	}
-
-	sm, err := d.DB.Prepare(getSQL)
-	if err != nil {
-		return ACMETxt{}, err
-	}
-	defer sm.Close()
-	rows, err := sm.Query(u.String())
+	rows, err := d.DB.Query(getSQL, args...)
 	if err != nil {
-		return ACMETxt{}, err
+		return results, err
 	}
 	defer rows.Close()
-
-	// It will only be one row though
 	for rows.Next() {
-		txt, err := getModelFromRow(rows)
+		var rt RegToken
+		err = rows.Scan(&rt.ID, &rt.DomainPattern, &rt.MaxUses, &rt.Uses, &rt.Expires, &rt.CreatedAt, &rt.TenantID)
 		if err != nil {
-			return ACMETxt{}, err
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in GetRegTokens")
+			return results, err
 		}
-		results = append(results, txt)
-	}
-	if len(results) > 0 {
-		return results[0], nil
+		results = append(results, rt)
 	}
-	return ACMETxt{}, errors.New("no user")
+	return results, rows.Err()
 }
 
-func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
+// DeleteRegToken revokes a registration token, records created with it are kept. Tenant administrators
+// may only revoke the tokens of their tenant.
+func (d *acmedb) DeleteRegToken(actor Actor, id string) error {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
-	domain = sanitizeString(domain)
-	var txts []string
-	getSQL := `
-	SELECT Value FROM txt WHERE Subdomain=$1 LIMIT 2
-	`
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	var tenant string
+	getSQL := `SELECT COALESCE(TenantID, '') FROM regtokens WHERE ID=$1`
+	delSQL := `DELETE FROM regtokens WHERE ID=$1`
 	if Config.Database.Engine == "sqlite3" {
 		getSQL = getSQLiteStmt(getSQL)
+		delSQL = getSQLiteStmt(delSQL)
 	}
-
-	sm, err := d.DB.Prepare(getSQL)
-	if err != nil {
+	err = tx.QueryRow(getSQL, id).Scan(&tenant)
+	if err == sql.ErrNoRows || (err == nil && !actor.isSuperadmin() && tenant != actor.Tenant) {
+		err = errNoRecord
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(delSQL, id)
+	if err != nil {
+		return err
+	}
+	err = writeAuditInTransaction(tx, actor, tenant, auditDeleteRegToken, "", id, "")
+	return err
+}
+
+// UpdateDomainName updates the domain name for a given subdomain. Administrators may update the records
+// of their tenant, superadministrators any record, other callers only the record they own.
+func (d *acmedb) UpdateDomainName(actor Actor, subdomain string, domainName string) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	rec, err := d.getRecordForActorInTransaction(tx, actor, subdomain)
+	if err != nil {
+		return err
+	}
+	var oldName string
+	getSQL := `SELECT COALESCE(DomainName, '') FROM records WHERE Username = $1`
+	updSQL := `UPDATE records SET DomainName = $1, UpdatedAt = $2 WHERE Username = $3`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+		updSQL = getSQLiteStmt(updSQL)
+	}
+	err = tx.QueryRow(getSQL, rec.Username.String()).Scan(&oldName)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(updSQL, domainName, time.Now().Unix(), rec.Username.String())
+	if err != nil {
+		return err
+	}
+	err = writeAuditInTransaction(tx, actor, rec.TenantID, auditUpdateDomainName, rec.Subdomain, oldName, domainName)
+	return err
+}
+
+// DeleteRecord removes the record and its TXT values for a given subdomain. Administrators may delete
+// the records of their tenant, superadministrators any record, other callers only the record they own.
+func (d *acmedb) DeleteRecord(actor Actor, subdomain string) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	rec, err := d.getRecordForActorInTransaction(tx, actor, subdomain)
+	if err != nil {
+		return err
+	}
+	for _, delSQL := range []string{
+		`DELETE FROM records WHERE Username = $1`,
+		`DELETE FROM rotated WHERE Username = $1`,
+		`DELETE FROM labels WHERE Username = $1`,
+	} {
+		if Config.Database.Engine == "sqlite3" {
+			delSQL = getSQLiteStmt(delSQL)
+		}
+		_, err = tx.Exec(delSQL, rec.Username.String())
+		if err != nil {
+			return err
+		}
+	}
+	txtSQL := `DELETE FROM txt WHERE Subdomain = $1`
+	if Config.Database.Engine == "sqlite3" {
+		txtSQL = getSQLiteStmt(txtSQL)
+	}
+	_, err = tx.Exec(txtSQL, rec.Subdomain)
+	if err != nil {
+		return err
+	}
+	err = writeAuditInTransaction(tx, actor, rec.TenantID, auditDelete, rec.Subdomain, "", "")
+	return err
+}
+
+// UpdateAllowFrom replaces the allowed source networks of the record for a given subdomain
+func (d *acmedb) UpdateAllowFrom(actor Actor, subdomain string, afrom cidrslice) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	rec, err := d.getRecordForActorInTransaction(tx, actor, subdomain)
+	if err != nil {
+		return err
+	}
+	updSQL := `UPDATE records SET AllowFrom = $1, UpdatedAt = $2 WHERE Username = $3`
+	if Config.Database.Engine == "sqlite3" {
+		updSQL = getSQLiteStmt(updSQL)
+	}
+	_, err = tx.Exec(updSQL, afrom.JSON(), time.Now().Unix(), rec.Username.String())
+	if err != nil {
+		return err
+	}
+	err = writeAuditInTransaction(tx, actor, rec.TenantID, auditUpdateAllowFrom, rec.Subdomain, rec.AllowFrom.JSON(), afrom.JSON())
+	return err
+}
+
+// SetTXTSlots changes the number of TXT values kept for the record for a given subdomain. Missing slots are
+// added empty, surplus ones are removed starting from the least recently updated.
+func (d *acmedb) SetTXTSlots(actor Actor, subdomain string, slots int) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	rec, err := d.getRecordForActorInTransaction(tx, actor, subdomain)
+	if err != nil {
+		return err
+	}
+	cntSQL := `SELECT COUNT(*) FROM txt WHERE Subdomain=$1`
+	delSQL := `DELETE FROM txt WHERE rowid IN (SELECT rowid FROM txt WHERE Subdomain=$1 ORDER BY LastUpdate LIMIT $2)`
+	updSQL := `UPDATE records SET TXTSlots = $1, UpdatedAt = $2 WHERE Username = $3`
+	if Config.Database.Engine == "sqlite3" {
+		cntSQL = getSQLiteStmt(cntSQL)
+		delSQL = getSQLiteStmt(delSQL)
+		updSQL = getSQLiteStmt(updSQL)
+	}
+	// Existing records may have a different number of rows than recorded, eg. after the upgrade to version 3
+	var current int
+	err = tx.QueryRow(cntSQL, rec.Subdomain).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if slots > current {
+		err = d.NewTXTValuesInTransaction(tx, rec.Subdomain, slots-current)
+	} else if slots < current {
+		_, err = tx.Exec(delSQL, rec.Subdomain, current-slots)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(updSQL, slots, time.Now().Unix(), rec.Username.String())
+	if err != nil {
+		return err
+	}
+	err = writeAuditInTransaction(tx, actor, rec.TenantID, auditUpdateTXTSlots, rec.Subdomain, strconv.Itoa(current), strconv.Itoa(slots))
+	return err
+}
+
+// UpdateMetadata changes the labels, note and owner of the record for a given subdomain and returns the record
+// with the resulting values
+func (d *acmedb) UpdateMetadata(actor Actor, subdomain string, upd MetadataUpdate) (ACMETxt, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	rec, err := d.getRecordForActorInTransaction(tx, actor, subdomain)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	getSQL := `SELECT COALESCE(Note, ''), COALESCE(Owner, '') FROM records WHERE Username = $1`
+	lblSQL := `SELECT Name, Value FROM labels WHERE Username = $1`
+	updSQL := `UPDATE records SET Note = $1, Owner = $2, UpdatedAt = $3 WHERE Username = $4`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+		lblSQL = getSQLiteStmt(lblSQL)
+		updSQL = getSQLiteStmt(updSQL)
+	}
+	err = tx.QueryRow(getSQL, rec.Username.String()).Scan(&rec.Note, &rec.Owner)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	rec.Labels = map[string]string{}
+	rows, err := tx.Query(lblSQL, rec.Username.String())
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	for rows.Next() {
+		var name, value string
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			rows.Close()
+			return ACMETxt{}, err
+		}
+		rec.Labels[name] = value
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return ACMETxt{}, err
+	}
+	old, _ := json.Marshal(map[string]interface{}{"labels": rec.Labels, "note": rec.Note, "owner": rec.Owner})
+
+	if upd.Labels != nil {
+		rec.Labels = *upd.Labels
+		if rec.Labels == nil {
+			rec.Labels = map[string]string{}
+		}
+		err = setLabelsInTransaction(tx, rec.Username.String(), rec.Labels)
+		if err != nil {
+			return ACMETxt{}, err
+		}
+	}
+	if upd.Note != nil {
+		rec.Note = *upd.Note
+	}
+	if upd.Owner != nil {
+		rec.Owner = *upd.Owner
+	}
+	_, err = tx.Exec(updSQL, rec.Note, rec.Owner, time.Now().Unix(), rec.Username.String())
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	updated, _ := json.Marshal(map[string]interface{}{"labels": rec.Labels, "note": rec.Note, "owner": rec.Owner})
+	err = writeAuditInTransaction(tx, actor, rec.TenantID, auditUpdateMetadata, rec.Subdomain, string(old), string(updated))
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	return rec, nil
+}
+
+// RotatePassword replaces the password of the record for a given subdomain and returns the record with
+// the new plaintext password. If grace is positive, the previous password stays valid for that duration.
+func (d *acmedb) RotatePassword(actor Actor, subdomain string, grace time.Duration) (ACMETxt, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	rec, err := d.getRecordForActorInTransaction(tx, actor, subdomain)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	oldHash := rec.Password
+	rec.Password = generatePassword(40)
+	passwordHash, err := hashPassword(rec.Password)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	timenow := time.Now()
+
+	updSQL := `UPDATE records SET Password = $1, UpdatedAt = $2 WHERE Username = $3`
+	// Only the password replaced now may have a grace period
+	delSQL := `DELETE FROM rotated WHERE Username = $1 OR Expires < $2`
+	insSQL := `INSERT INTO rotated (Username, Password, Expires) values($1, $2, $3)`
+	if Config.Database.Engine == "sqlite3" {
+		updSQL = getSQLiteStmt(updSQL)
+		delSQL = getSQLiteStmt(delSQL)
+		insSQL = getSQLiteStmt(insSQL)
+	}
+	_, err = tx.Exec(updSQL, passwordHash, timenow.Unix(), rec.Username.String())
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	_, err = tx.Exec(delSQL, rec.Username.String(), timenow.Unix())
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	if grace > 0 {
+		_, err = tx.Exec(insSQL, rec.Username.String(), oldHash, timenow.Add(grace).Unix())
+		if err != nil {
+			return ACMETxt{}, err
+		}
+	}
+	err = writeAuditInTransaction(tx, actor, rec.TenantID, auditRotatePassword, rec.Subdomain, "", "")
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	return rec, nil
+}
+
+// GetRotatedPasswords returns the hashes of previous passwords of a user that are still within their grace period
+func (d *acmedb) GetRotatedPasswords(u uuid.UUID) ([]string, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var hashes []string
+	getSQL := `SELECT Password FROM rotated WHERE Username=$1 AND Expires >= $2`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	rows, err := d.DB.Query(getSQL, u.String(), time.Now().Unix())
+	if err != nil {
+		return hashes, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return hashes, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// UpdatePasswordHash replaces the password hash of a user with one of the same password made with
+// current parameters. Nothing is changed if the password was rotated in the meantime.
+func (d *acmedb) UpdatePasswordHash(username uuid.UUID, oldHash string, newHash string) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	// Hashes of older versions are stored as blobs in sqlite
+	updSQL := `UPDATE records SET Password = $1 WHERE Username = $2 AND CAST(Password AS TEXT) = $3`
+	getSQL := `SELECT Subdomain, COALESCE(TenantID, '') FROM records WHERE Username = $1`
+	if Config.Database.Engine == "sqlite3" {
+		updSQL = getSQLiteStmt(updSQL)
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	res, err := tx.Exec(updSQL, newHash, username.String(), oldHash)
+	if err != nil {
+		return err
+	}
+	// The hash was changed in the meantime, eg. upgraded by a concurrent request
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	var subdomain, tenant string
+	err = tx.QueryRow(getSQL, username.String()).Scan(&subdomain, &tenant)
+	if err != nil {
+		return err
+	}
+	err = insertAuditInTransaction(tx, AuditEntry{Actor: auditSystemActor, Action: auditRehashPassword, Subdomain: subdomain, OldValue: hashScheme(oldHash), NewValue: hashScheme(newHash), TenantID: tenant})
+	return err
+}
+
+// getRecordForActorInTransaction returns the record for a given subdomain if the actor is allowed to modify it.
+// Records of other tenants are reported as missing to tenant administrators.
+func (d *acmedb) getRecordForActorInTransaction(tx *sql.Tx, actor Actor, subdomain string) (ACMETxt, error) {
+	getSQL := `
+	SELECT Username, Password, Subdomain, AllowFrom, COALESCE(TenantID, '')
+	FROM records
+	WHERE Subdomain=$1 LIMIT 1
+	`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	rows, err := tx.Query(getSQL, subdomain)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if actor.isAdmin() {
+			return ACMETxt{}, errNoRecord
+		}
+		return ACMETxt{}, errNotOwner
+	}
+	rec, err := getModelFromRow(rows)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	if actor.isAdmin() && !actor.isSuperadmin() && rec.TenantID != actor.Tenant {
+		return ACMETxt{}, errNoRecord
+	}
+	if !actor.isAdmin() && rec.Username != actor.Username {
+		return ACMETxt{}, errNotOwner
+	}
+	return rec, nil
+}
+
+// domainSortColumns are the expressions the domains list can be sorted by
+var domainSortColumns = map[string]string{
+	"created_at": "COALESCE(CreatedAt, 0)",
+	"updated_at": "COALESCE(UpdatedAt, 0)",
+}
+
+// domainFilterSQL returns the WHERE clause and its arguments for the filters of the query, and for its
+// cursor if withCursor is set
+func domainFilterSQL(q DomainQuery, withCursor bool) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if q.TenantID != "" {
+		args = append(args, q.TenantID)
+		where = append(where, fmt.Sprintf("TenantID = $%d", len(args)))
+	}
+	names := make([]string, 0, len(q.Labels))
+	for name := range q.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, name, q.Labels[name])
+		where = append(where, fmt.Sprintf("Username IN (SELECT Username FROM labels WHERE Name = $%d AND Value = $%d)", len(args)-1, len(args)))
+	}
+	if q.Search != "" {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(q.Search)) + "%"
+		// The pattern is passed twice, SQLite placeholders can not be reused
+		args = append(args, pattern, pattern)
+		where = append(where, fmt.Sprintf(`(LOWER(Subdomain) LIKE $%d ESCAPE '\' OR LOWER(COALESCE(DomainName, '')) LIKE $%d ESCAPE '\')`, len(args)-1, len(args)))
+	}
+	if withCursor && q.Cursor != nil {
+		column, ok := domainSortColumns[q.SortBy]
+		if !ok {
+			column = domainSortColumns["created_at"]
+		}
+		op := ">"
+		if q.Descending {
+			op = "<"
+		}
+		args = append(args, q.Cursor.Value, q.Cursor.Value, q.Cursor.Username)
+		where = append(where, fmt.Sprintf("(%s %s $%d OR (%s = $%d AND Username %s $%d))", column, op, len(args)-2, column, len(args)-1, op, len(args)))
+	}
+	if len(where) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+// CountDomains returns the number of records matching the filters of the query
+func (d *acmedb) CountDomains(q DomainQuery) (int, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var count int
+	where, args := domainFilterSQL(q, false)
+	getSQL := `SELECT COUNT(*) FROM records` + where
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	err := d.DB.QueryRow(getSQL, args...).Scan(&count)
+	return count, err
+}
+
+// GetDomains returns a page of the records matching the query without their password hashes
+func (d *acmedb) GetDomains(q DomainQuery) ([]ACMETxt, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var results []ACMETxt
+	getSQL := `
+	SELECT Username, Password, Subdomain, AllowFrom,
+	       COALESCE(DomainName, '') as DomainName,
+	       COALESCE(CreatedAt, 0) as CreatedAt,
+	       COALESCE(UpdatedAt, 0) as UpdatedAt,
+	       COALESCE(TXTSlots, 2) as TXTSlots,
+	       COALESCE(RegToken, '') as RegToken,
+	       COALESCE(TenantID, '') as TenantID,
+	       COALESCE(Note, '') as Note,
+	       COALESCE(Owner, '') as Owner
+	FROM records`
+	where, args := domainFilterSQL(q, true)
+	column, ok := domainSortColumns[q.SortBy]
+	if !ok {
+		column = domainSortColumns["created_at"]
+	}
+	direction := "ASC"
+	if q.Descending {
+		direction = "DESC"
+	}
+	getSQL += where + fmt.Sprintf(" ORDER BY %s %s, Username %s", column, direction, direction)
+	if q.Limit > 0 {
+		getSQL += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	rows, err := d.DB.Query(getSQL, args...)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		txt := ACMETxt{}
+		afrom := ""
+		err = rows.Scan(&txt.Username, &txt.Password, &txt.Subdomain, &afrom,
+			&txt.DomainName, &txt.CreatedAt, &txt.UpdatedAt, &txt.TXTSlots, &txt.RegToken, &txt.TenantID,
+			&txt.Note, &txt.Owner)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in GetDomains")
+			return results, err
+		}
+		txt.AllowFrom.Unmarshal(afrom)
+		// Clear password hash for security
+		txt.Password = ""
+		// Add fulldomain
+		txt.Fulldomain = txt.Subdomain + "." + Config.General.Domain
+		results = append(results, txt)
+	}
+	if err = rows.Err(); err != nil {
+		return results, err
+	}
+	rows.Close()
+	err = d.addLabels(results)
+	return results, err
+}
+
+// addLabels fills in the labels of the records
+func (d *acmedb) addLabels(records []ACMETxt) error {
+	// Keep the number of parameters of a query well below the database limits
+	const batch = 500
+	for start := 0; start < len(records); start += batch {
+		end := start + batch
+		if end > len(records) {
+			end = len(records)
+		}
+		index := make(map[string]int)
+		var placeholders []string
+		var args []interface{}
+		for i := start; i < end; i++ {
+			records[i].Labels = map[string]string{}
+			index[records[i].Username.String()] = i
+			args = append(args, records[i].Username.String())
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+		}
+		getSQL := `SELECT Username, Name, Value FROM labels WHERE Username IN (` + strings.Join(placeholders, ", ") + `)`
+		if Config.Database.Engine == "sqlite3" {
+			getSQL = getSQLiteStmt(getSQL)
+		}
+		rows, err := d.DB.Query(getSQL, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var username, name, value string
+			err = rows.Scan(&username, &name, &value)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if i, ok := index[username]; ok {
+				records[i].Labels[name] = value
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLabelsInTransaction replaces the labels of the user
+func setLabelsInTransaction(tx *sql.Tx, username string, labels map[string]string) error {
+	delSQL := `DELETE FROM labels WHERE Username = $1`
+	insSQL := `INSERT INTO labels (Username, Name, Value) values($1, $2, $3)`
+	if Config.Database.Engine == "sqlite3" {
+		delSQL = getSQLiteStmt(delSQL)
+		insSQL = getSQLiteStmt(insSQL)
+	}
+	_, err := tx.Exec(delSQL, username)
+	if err != nil {
+		return err
+	}
+	for name, value := range labels {
+		_, err = tx.Exec(insSQL, username, name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *acmedb) GetByUsername(u uuid.UUID) (ACMETxt, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var results []ACMETxt
+	getSQL := `
+	SELECT Username, Password, Subdomain, AllowFrom, COALESCE(TenantID, '')
+	FROM records
+	WHERE Username=$1 LIMIT 1
+	`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+
+	sm, err := d.DB.Prepare(getSQL)
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	defer sm.Close()
+	rows, err := sm.Query(u.String())
+	if err != nil {
+		return ACMETxt{}, err
+	}
+	defer rows.Close()
+
+	// It will only be one row though
+	for rows.Next() {
+		txt, err := getModelFromRow(rows)
+		if err != nil {
+			return ACMETxt{}, err
+		}
+		results = append(results, txt)
+	}
+	if len(results) > 0 {
+		return results[0], nil
+	}
+	return ACMETxt{}, errors.New("no user")
+}
+
+func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	domain = sanitizeString(domain)
+	var txts []string
+	getSQL := `
+	SELECT Value FROM txt WHERE Subdomain=$1
+	`
+	args := []interface{}{domain}
+	if Config.General.TXTTTLMinutes > 0 {
+		// Values older than the max age are not served even before the janitor clears them
+		getSQL += ` AND LastUpdate >= $2`
+		args = append(args, time.Now().Add(-time.Duration(Config.General.TXTTTLMinutes)*time.Minute).Unix())
+	}
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+
+	sm, err := d.DB.Prepare(getSQL)
+	if err != nil {
 		return txts, err
 	}
 	defer sm.Close()
-	rows, err := sm.Query(domain)
+	rows, err := sm.Query(args...)
 	if err != nil {
 		return txts, err
 	}
@@ -434,34 +1470,417 @@ func (d *acmedb) GetTXTForDomain(domain string) ([]string, error) {
 	return txts, nil
 }
 
-func (d *acmedb) Update(a ACMETxtPost) error {
+func (d *acmedb) Update(actor Actor, a ACMETxtPost) error {
 	d.Mutex.Lock()
 	defer d.Mutex.Unlock()
 	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
 	// Data in a is already sanitized
 	timenow := time.Now().Unix()
 
-	updSQL := `
-	UPDATE txt SET Value=$1, LastUpdate=$2
-	WHERE rowid=(
-		SELECT rowid FROM txt WHERE Subdomain=$3 ORDER BY LastUpdate LIMIT 1)
-	`
+	var rowid int64
+	var oldValue string
+	getSQL := `SELECT rowid, Value FROM txt WHERE Subdomain=$1 ORDER BY LastUpdate LIMIT 1`
+	updSQL := `UPDATE txt SET Value=$1, LastUpdate=$2 WHERE rowid=$3`
 	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
 		updSQL = getSQLiteStmt(updSQL)
 	}
 
-	sm, err := d.DB.Prepare(updSQL)
+	err = tx.QueryRow(getSQL, a.Subdomain).Scan(&rowid, &oldValue)
+	if err == sql.ErrNoRows {
+		// Nothing to update
+		err = nil
+		return err
+	}
 	if err != nil {
 		return err
 	}
-	defer sm.Close()
-	_, err = sm.Exec(a.Value, timenow, a.Subdomain)
+	_, err = tx.Exec(updSQL, a.Value, timenow, rowid)
+	if err != nil {
+		return err
+	}
+	err = writeAuditInTransaction(tx, actor, actor.Tenant, auditUpdateTXT, a.Subdomain, oldValue, a.Value)
+	return err
+}
+
+// ClearTXT empties the TXT value of the subdomain matching a.Value, or all of them if it is empty
+func (d *acmedb) ClearTXT(actor Actor, a ACMETxtPost) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	// Data in a is already sanitized
+	getSQL := `SELECT Value FROM txt WHERE Value != '' AND Subdomain=$1`
+	clrSQL := `UPDATE txt SET Value='', LastUpdate=0 WHERE Subdomain=$1`
+	args := []interface{}{a.Subdomain}
+	if a.Value != "" {
+		getSQL += ` AND Value=$2`
+		clrSQL += ` AND Value=$2`
+		args = append(args, a.Value)
+	}
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+		clrSQL = getSQLiteStmt(clrSQL)
+	}
+
+	rows, err := tx.Query(getSQL, args...)
+	if err != nil {
+		return err
+	}
+	var cleared []string
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		cleared = append(cleared, value)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(clrSQL, args...)
+	if err != nil {
+		return err
+	}
+	for _, value := range cleared {
+		err = writeAuditInTransaction(tx, actor, actor.Tenant, auditClearTXT, a.Subdomain, value, "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *acmedb) ExpireTXT(before int64) ([]ACMETxtPost, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var cleared []ACMETxtPost
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return cleared, err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	var tenants []string
+	getSQL := `
+	SELECT txt.Subdomain, txt.Value, COALESCE(records.TenantID, '')
+	FROM txt LEFT JOIN records ON records.Subdomain = txt.Subdomain
+	WHERE txt.Value != '' AND txt.LastUpdate < $1`
+	clrSQL := `UPDATE txt SET Value='' WHERE Value != '' AND LastUpdate < $1`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+		clrSQL = getSQLiteStmt(clrSQL)
+	}
+	rows, err := tx.Query(getSQL, before)
+	if err != nil {
+		return cleared, err
+	}
+	for rows.Next() {
+		var txt ACMETxtPost
+		var tenant string
+		err = rows.Scan(&txt.Subdomain, &txt.Value, &tenant)
+		if err != nil {
+			rows.Close()
+			return cleared, err
+		}
+		cleared = append(cleared, txt)
+		tenants = append(tenants, tenant)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return cleared, err
+	}
+	_, err = tx.Exec(clrSQL, before)
+	if err != nil {
+		return cleared, err
+	}
+	for i, txt := range cleared {
+		err = insertAuditInTransaction(tx, AuditEntry{Actor: auditSystemActor, Action: auditExpireTXT, Subdomain: txt.Subdomain, OldValue: txt.Value, TenantID: tenants[i]})
+		if err != nil {
+			return cleared, err
+		}
+	}
+	return cleared, nil
+}
+
+// GetAuditLog returns the audit log entries matching the query, newest first
+func (d *acmedb) GetAuditLog(q AuditQuery) ([]AuditEntry, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var results []AuditEntry
+	var where []string
+	var args []interface{}
+	addFilter := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if q.Actor != "" {
+		addFilter("Actor=$%d", q.Actor)
+	}
+	if q.IP != "" {
+		addFilter("IP=$%d", q.IP)
+	}
+	if q.Action != "" {
+		addFilter("Action=$%d", q.Action)
+	}
+	if q.Subdomain != "" {
+		addFilter("Subdomain=$%d", q.Subdomain)
+	}
+	if q.TenantID != "" {
+		addFilter("TenantID=$%d", q.TenantID)
+	}
+	if q.Since > 0 {
+		addFilter("Time>=$%d", q.Since)
+	}
+	if q.Until > 0 {
+		addFilter("Time<=$%d", q.Until)
+	}
+	if q.Cursor > 0 {
+		addFilter("ID<$%d", q.Cursor)
+	}
+	limit := q.Limit
+	if limit < 1 {
+		limit = defaultAuditLimit
+	}
+	getSQL := `SELECT ID, Time, Actor, IP, Action, Subdomain, OldValue, NewValue, COALESCE(TenantID, '') FROM audit`
+	if len(where) > 0 {
+		getSQL += " WHERE " + strings.Join(where, " AND ")
+	}
+	getSQL += fmt.Sprintf(" ORDER BY ID DESC LIMIT %d", limit)
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	rows, err := d.DB.Query(getSQL, args...)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEntry
+		err = rows.Scan(&e.ID, &e.Time, &e.Actor, &e.IP, &e.Action, &e.Subdomain, &e.OldValue, &e.NewValue, &e.TenantID)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in GetAuditLog")
+			return results, err
+		}
+		results = append(results, e)
+	}
+	return results, rows.Err()
+}
+
+// tenantExistsInTransaction returns errNoTenant if there is no tenant with the ID
+func tenantExistsInTransaction(tx *sql.Tx, id string) error {
+	var count int
+	getSQL := `SELECT COUNT(*) FROM tenants WHERE ID=$1`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	err := tx.QueryRow(getSQL, id).Scan(&count)
 	if err != nil {
 		return err
 	}
+	if count == 0 {
+		return errNoTenant
+	}
 	return nil
 }
 
+// NewTenant creates a tenant and returns it with the plaintext admin token
+func (d *acmedb) NewTenant(actor Actor, name string) (Tenant, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	t := Tenant{ID: uuid.New().String(), Name: name, Token: generatePassword(40), CreatedAt: time.Now().Unix()}
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return t, err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	insSQL := `INSERT INTO tenants(ID, Name, Token, CreatedAt) values($1, $2, $3, $4)`
+	if Config.Database.Engine == "sqlite3" {
+		insSQL = getSQLiteStmt(insSQL)
+	}
+	_, err = tx.Exec(insSQL, t.ID, t.Name, hashToken(t.Token), t.CreatedAt)
+	if err != nil {
+		return t, err
+	}
+	err = writeAuditInTransaction(tx, actor, t.ID, auditCreateTenant, "", "", t.Name)
+	return t, err
+}
+
+// GetTenants returns all tenants without their admin tokens
+func (d *acmedb) GetTenants() ([]Tenant, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var results []Tenant
+	rows, err := d.DB.Query(`SELECT ID, Name, CreatedAt FROM tenants ORDER BY Name`)
+	if err != nil {
+		return results, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t Tenant
+		err = rows.Scan(&t.ID, &t.Name, &t.CreatedAt)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Database error in GetTenants")
+			return results, err
+		}
+		results = append(results, t)
+	}
+	return results, rows.Err()
+}
+
+// GetTenantByToken returns the tenant with the admin token
+func (d *acmedb) GetTenantByToken(token string) (Tenant, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var t Tenant
+	getSQL := `SELECT ID, Name, CreatedAt FROM tenants WHERE Token=$1`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+	}
+	err := d.DB.QueryRow(getSQL, hashToken(token)).Scan(&t.ID, &t.Name, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return t, errNoRecord
+	}
+	return t, err
+}
+
+// RotateTenantToken replaces the admin token of a tenant and returns the tenant with the new plaintext token
+func (d *acmedb) RotateTenantToken(actor Actor, id string) (Tenant, error) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	var t Tenant
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return t, err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	getSQL := `SELECT ID, Name, CreatedAt FROM tenants WHERE ID=$1`
+	updSQL := `UPDATE tenants SET Token=$1 WHERE ID=$2`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+		updSQL = getSQLiteStmt(updSQL)
+	}
+	err = tx.QueryRow(getSQL, id).Scan(&t.ID, &t.Name, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = errNoRecord
+		return t, err
+	}
+	if err != nil {
+		return t, err
+	}
+	t.Token = generatePassword(40)
+	_, err = tx.Exec(updSQL, hashToken(t.Token), t.ID)
+	if err != nil {
+		return t, err
+	}
+	err = writeAuditInTransaction(tx, actor, t.ID, auditRotateTenant, "", "", "")
+	return t, err
+}
+
+// DeleteTenant removes a tenant and its registration tokens. Tenants that still have records are not deleted.
+func (d *acmedb) DeleteTenant(actor Actor, id string) error {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	var err error
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback if errored, commit if not
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		_ = tx.Commit()
+	}()
+	var name string
+	var records int
+	getSQL := `SELECT Name FROM tenants WHERE ID=$1`
+	countSQL := `SELECT COUNT(*) FROM records WHERE TenantID=$1`
+	delTokensSQL := `DELETE FROM regtokens WHERE TenantID=$1`
+	delSQL := `DELETE FROM tenants WHERE ID=$1`
+	if Config.Database.Engine == "sqlite3" {
+		getSQL = getSQLiteStmt(getSQL)
+		countSQL = getSQLiteStmt(countSQL)
+		delTokensSQL = getSQLiteStmt(delTokensSQL)
+		delSQL = getSQLiteStmt(delSQL)
+	}
+	err = tx.QueryRow(getSQL, id).Scan(&name)
+	if err == sql.ErrNoRows {
+		err = errNoRecord
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(countSQL, id).Scan(&records)
+	if err != nil {
+		return err
+	}
+	if records > 0 {
+		err = errTenantInUse
+		return err
+	}
+	for _, q := range []string{delTokensSQL, delSQL} {
+		_, err = tx.Exec(q, id)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeAuditInTransaction(tx, actor, id, auditDeleteTenant, "", name, "")
+	return err
+}
+
 func getModelFromRow(r *sql.Rows) (ACMETxt, error) {
 	txt := ACMETxt{}
 	afrom := ""
@@ -469,7 +1888,8 @@ func getModelFromRow(r *sql.Rows) (ACMETxt, error) {
 		&txt.Username,
 		&txt.Password,
 		&txt.Subdomain,
-		&afrom)
+		&afrom,
+		&txt.TenantID)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err.Error()}).Error("Row scan error")
 	}
@@ -5,7 +5,10 @@ import (
 	"database/sql/driver"
 	"errors"
 	"github.com/erikstmartin/go-testdb"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 )
 
 type testResult struct {
@@ -161,7 +164,7 @@ func TestQueryExecErrors(t *testing.T) {
 		t.Errorf("Expected error from exec in Register, but got none")
 	}
 	reg.Value = "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"
-	err = DB.Update(reg.ACMETxtPost)
+	err = DB.Update(Actor{}, reg.ACMETxtPost)
 	if err == nil {
 		t.Errorf("Expected error from exec in Update, but got none")
 	}
@@ -238,10 +241,10 @@ func TestGetTXTForDomain(t *testing.T) {
 	txtval2 := "___validation_token_received_YEAH_the_ca___"
 
 	reg.Value = txtval1
-	_ = DB.Update(reg.ACMETxtPost)
+	_ = DB.Update(Actor{}, reg.ACMETxtPost)
 
 	reg.Value = txtval2
-	_ = DB.Update(reg.ACMETxtPost)
+	_ = DB.Update(Actor{}, reg.ACMETxtPost)
 
 	regDomainSlice, err := DB.GetTXTForDomain(reg.Subdomain)
 	if err != nil {
@@ -294,8 +297,527 @@ func TestUpdate(t *testing.T) {
 	regUser.Password = "nevergonnagiveyouup"
 	regUser.Value = validTXT
 
-	err = DB.Update(regUser.ACMETxtPost)
+	err = DB.Update(Actor{}, regUser.ACMETxtPost)
 	if err != nil {
 		t.Errorf("DB Update failed, got error: [%v]", err)
 	}
 }
+
+func TestUpdateDomainName(t *testing.T) {
+	reg, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	other, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	owner := Actor{Username: reg.Username, Subdomain: reg.Subdomain}
+
+	if err = DB.UpdateDomainName(owner, reg.Subdomain, "example.com"); err != nil {
+		t.Errorf("Expected owner to be able to update domain name, got error [%v]", err)
+	}
+	if err = DB.UpdateDomainName(owner, other.Subdomain, "example.com"); err != errNotOwner {
+		t.Errorf("Expected error [%v] when updating record of another user, got [%v]", errNotOwner, err)
+	}
+	if err = DB.UpdateDomainName(Actor{Admin: "admin"}, other.Subdomain, "example.org"); err != nil {
+		t.Errorf("Expected admin to be able to update domain name, got error [%v]", err)
+	}
+	if err = DB.UpdateDomainName(Actor{Admin: "admin"}, "does-not-exist", "example.org"); err != errNoRecord {
+		t.Errorf("Expected error [%v] for nonexistent record, got [%v]", errNoRecord, err)
+	}
+}
+
+func TestDeleteRecord(t *testing.T) {
+	reg, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	other, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	owner := Actor{Username: reg.Username, Subdomain: reg.Subdomain}
+
+	if err = DB.DeleteRecord(owner, other.Subdomain); err != errNotOwner {
+		t.Errorf("Expected error [%v] when deleting record of another user, got [%v]", errNotOwner, err)
+	}
+	if err = DB.DeleteRecord(owner, reg.Subdomain); err != nil {
+		t.Errorf("Expected owner to be able to delete record, got error [%v]", err)
+	}
+	if _, err = DB.GetByUsername(reg.Username); err == nil {
+		t.Errorf("Expected deleted user to be gone")
+	}
+	var txtRows int
+	_ = DB.GetBackend().QueryRow("SELECT COUNT(*) FROM txt WHERE Subdomain = '" + reg.Subdomain + "'").Scan(&txtRows)
+	if txtRows != 0 {
+		t.Errorf("Expected TXT rows of deleted record to be gone, found [%d]", txtRows)
+	}
+	if err = DB.DeleteRecord(Actor{Admin: "admin"}, other.Subdomain); err != nil {
+		t.Errorf("Expected admin to be able to delete record, got error [%v]", err)
+	}
+	if err = DB.DeleteRecord(Actor{Admin: "admin"}, other.Subdomain); err != errNoRecord {
+		t.Errorf("Expected error [%v] for already deleted record, got [%v]", errNoRecord, err)
+	}
+}
+
+func TestClearTXT(t *testing.T) {
+	reg, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	txtval1 := "___validation_token_received_from_the_ca___"
+	txtval2 := "___validation_token_received_YEAH_the_ca___"
+	reg.Value = txtval1
+	_ = DB.Update(Actor{}, reg.ACMETxtPost)
+	reg.Value = txtval2
+	_ = DB.Update(Actor{}, reg.ACMETxtPost)
+
+	// Clear a single value
+	reg.Value = txtval1
+	if err = DB.ClearTXT(Actor{}, reg.ACMETxtPost); err != nil {
+		t.Errorf("ClearTXT failed, got error [%v]", err)
+	}
+	txts, _ := DB.GetTXTForDomain(reg.Subdomain)
+	for _, v := range txts {
+		if v == txtval1 {
+			t.Errorf("Expected value [%s] to be cleared", txtval1)
+		}
+	}
+	if len(txts) != 2 {
+		t.Errorf("Expected TXT slots to be kept, got [%d]", len(txts))
+	}
+
+	// Clear all values
+	reg.Value = ""
+	if err = DB.ClearTXT(Actor{}, reg.ACMETxtPost); err != nil {
+		t.Errorf("ClearTXT failed, got error [%v]", err)
+	}
+	txts, _ = DB.GetTXTForDomain(reg.Subdomain)
+	for _, v := range txts {
+		if v != "" {
+			t.Errorf("Expected all values to be cleared, got [%s]", v)
+		}
+	}
+}
+
+func TestRegisterTXTSlots(t *testing.T) {
+	reg, err := DB.RegisterRecord(registration{TXTSlots: 5})
+	if err != nil {
+		t.Errorf("Registration failed, got error [%v]", err)
+	}
+	if reg.TXTSlots != 5 {
+		t.Errorf("Expected record with [5] TXT slots, got [%d]", reg.TXTSlots)
+	}
+	values := []string{
+		"___validation_token_received_from_the_ca1__",
+		"___validation_token_received_from_the_ca2__",
+		"___validation_token_received_from_the_ca3__",
+		"___validation_token_received_from_the_ca4__",
+		"___validation_token_received_from_the_ca5__",
+	}
+	for _, v := range values {
+		reg.Value = v
+		_ = DB.Update(Actor{}, reg.ACMETxtPost)
+	}
+	txts, err := DB.GetTXTForDomain(reg.Subdomain)
+	if err != nil {
+		t.Errorf("Could not get TXT values, got error [%v]", err)
+	}
+	if len(txts) != len(values) {
+		t.Errorf("Expected [%d] TXT values, got [%d]", len(values), len(txts))
+	}
+	for _, v := range values {
+		found := false
+		for _, txt := range txts {
+			if txt == v {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("TXT value [%s] not found", v)
+		}
+	}
+
+	// Configured default is used if not requested
+	Config.API.TXTSlots = 3
+	defer func() { Config.API.TXTSlots = 0 }()
+	reg, _ = DB.RegisterRecord(registration{})
+	txts, _ = DB.GetTXTForDomain(reg.Subdomain)
+	if len(txts) != 3 {
+		t.Errorf("Expected [3] TXT slots from config, got [%d]", len(txts))
+	}
+}
+
+func TestRegisterSubdomain(t *testing.T) {
+	reg, err := DB.RegisterRecord(registration{Subdomain: "my-zone"})
+	if err != nil {
+		t.Fatalf("Registration with requested subdomain failed: [%v]", err)
+	}
+	if reg.Subdomain != "my-zone" {
+		t.Errorf("Expected subdomain [my-zone], got [%s]", reg.Subdomain)
+	}
+	txts, _ := DB.GetTXTForDomain("my-zone")
+	if len(txts) != 2 {
+		t.Errorf("Expected TXT slots for the requested subdomain, got [%d]", len(txts))
+	}
+	if _, err = DB.RegisterRecord(registration{Subdomain: "my-zone"}); err != errSubdomainTaken {
+		t.Errorf("Expected errSubdomainTaken, got [%v]", err)
+	}
+	// The subdomain is passed to the TXT slot inserts as a parameter
+	if _, err = DB.RegisterRecord(registration{Subdomain: "it's-mine"}); err != nil {
+		t.Fatalf("Registration with quoted subdomain failed: [%v]", err)
+	}
+	var slots int
+	_ = DB.GetBackend().QueryRow("SELECT COUNT(*) FROM txt WHERE Subdomain=?", "it's-mine").Scan(&slots)
+	if slots != 2 {
+		t.Errorf("Expected TXT slots for the quoted subdomain, got [%d]", slots)
+	}
+}
+
+func TestDBUpgradeTo3(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "acmedns")
+	if err != nil {
+		t.Fatalf("Could not create temporary file")
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	olddb, _ := sql.Open("sqlite3", tmpfile.Name())
+	for _, stmt := range []string{
+		acmeTable,
+		`CREATE TABLE records(Username TEXT UNIQUE NOT NULL PRIMARY KEY, Password TEXT UNIQUE NOT NULL, Subdomain TEXT UNIQUE NOT NULL, AllowFrom TEXT, DomainName TEXT DEFAULT '', CreatedAt INT DEFAULT 0, UpdatedAt INT DEFAULT 0)`,
+		txtTable,
+		"INSERT INTO acmedns (Name, Value) values('db_version', '2')",
+		"INSERT INTO records (Username, Password, Subdomain, AllowFrom) values('a097455b-52cc-4569-90c8-7a4b97c6eba8', 'hash', 'old', '[]')",
+	} {
+		if _, err = olddb.Exec(stmt); err != nil {
+			t.Fatalf("Could not set up version 2 database: [%v]", err)
+		}
+	}
+	olddb.Close()
+
+	upgraded := new(acmedb)
+	if err = upgraded.Init("sqlite3", tmpfile.Name()); err != nil {
+		t.Fatalf("Database upgrade failed: [%v]", err)
+	}
+	defer upgraded.Close()
+	var version string
+	_ = upgraded.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&version)
+	if version != strconv.Itoa(DBVersion) {
+		t.Errorf("Expected database version [%d], got [%s]", DBVersion, version)
+	}
+	var slots int
+	err = upgraded.DB.QueryRow("SELECT TXTSlots FROM records WHERE Subdomain='old'").Scan(&slots)
+	if err != nil || slots != 2 {
+		t.Errorf("Expected existing record to have [2] TXT slots, got [%d] and error [%v]", slots, err)
+	}
+	var regToken string
+	err = upgraded.DB.QueryRow("SELECT RegToken FROM records WHERE Subdomain='old'").Scan(&regToken)
+	if err != nil || regToken != "" {
+		t.Errorf("Expected existing record to have no registration token, got [%s] and error [%v]", regToken, err)
+	}
+}
+
+func TestDBUpgradeTo5(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "acmedns")
+	if err != nil {
+		t.Fatalf("Could not create temporary file")
+	}
+	defer os.Remove(tmpfile.Name())
+	tmpfile.Close()
+
+	olddb, _ := sql.Open("sqlite3", tmpfile.Name())
+	for _, stmt := range []string{
+		acmeTable,
+		`CREATE TABLE records(Username TEXT UNIQUE NOT NULL PRIMARY KEY, Password TEXT UNIQUE NOT NULL, Subdomain TEXT UNIQUE NOT NULL, AllowFrom TEXT, DomainName TEXT DEFAULT '', CreatedAt INT DEFAULT 0, UpdatedAt INT DEFAULT 0, TXTSlots INT DEFAULT 2, RegToken TEXT DEFAULT '')`,
+		`CREATE TABLE regtokens(ID TEXT UNIQUE NOT NULL PRIMARY KEY, Token TEXT UNIQUE NOT NULL, DomainPattern TEXT DEFAULT '', MaxUses INT DEFAULT 1, Uses INT DEFAULT 0, Expires INT DEFAULT 0, CreatedAt INT DEFAULT 0)`,
+		`CREATE TABLE audit(ID INTEGER PRIMARY KEY AUTOINCREMENT, Time INT NOT NULL, Actor TEXT NOT NULL, IP TEXT DEFAULT '', Action TEXT NOT NULL, Subdomain TEXT DEFAULT '', OldValue TEXT DEFAULT '', NewValue TEXT DEFAULT '')`,
+		txtTable,
+		"INSERT INTO acmedns (Name, Value) values('db_version', '4')",
+		"INSERT INTO records (Username, Password, Subdomain, AllowFrom) values('a097455b-52cc-4569-90c8-7a4b97c6eba8', 'hash', 'old', '[]')",
+	} {
+		if _, err = olddb.Exec(stmt); err != nil {
+			t.Fatalf("Could not set up version 4 database: [%v]", err)
+		}
+	}
+	olddb.Close()
+
+	upgraded := new(acmedb)
+	if err = upgraded.Init("sqlite3", tmpfile.Name()); err != nil {
+		t.Fatalf("Database upgrade failed: [%v]", err)
+	}
+	defer upgraded.Close()
+	var version string
+	_ = upgraded.DB.QueryRow("SELECT Value FROM acmedns WHERE Name='db_version'").Scan(&version)
+	if version != strconv.Itoa(DBVersion) {
+		t.Errorf("Expected database version [%d], got [%s]", DBVersion, version)
+	}
+	for _, table := range []string{"records", "regtokens", "audit"} {
+		if _, err = upgraded.DB.Exec("SELECT TenantID FROM " + table); err != nil {
+			t.Errorf("Expected table %s to have a TenantID column, got error [%v]", table, err)
+		}
+	}
+	var tenant string
+	err = upgraded.DB.QueryRow("SELECT TenantID FROM records WHERE Subdomain='old'").Scan(&tenant)
+	if err != nil || tenant != "" {
+		t.Errorf("Expected existing record to have no tenant, got [%s] and error [%v]", tenant, err)
+	}
+	if _, err = upgraded.DB.Exec("SELECT Note, Owner FROM records"); err != nil {
+		t.Errorf("Expected records to have Note and Owner columns, got error [%v]", err)
+	}
+}
+
+func TestRegTokens(t *testing.T) {
+	rt, err := DB.NewRegToken(Actor{}, RegToken{DomainPattern: "*.example.com", MaxUses: 2})
+	if err != nil {
+		t.Fatalf("Could not create registration token: [%v]", err)
+	}
+	if rt.Token == "" || rt.ID == "" {
+		t.Fatalf("Expected token and ID to be set")
+	}
+
+	if _, err = DB.RegisterRecord(registration{RegToken: "not-a-token", DomainName: "a.example.com"}); err != errInvalidRegToken {
+		t.Errorf("Expected errInvalidRegToken for unknown token, got [%v]", err)
+	}
+	if _, err = DB.RegisterRecord(registration{RegToken: rt.Token, DomainName: "a.example.org"}); err != errInvalidRegToken {
+		t.Errorf("Expected errInvalidRegToken for domain outside the pattern, got [%v]", err)
+	}
+	for i := 0; i < 2; i++ {
+		reg, err := DB.RegisterRecord(registration{RegToken: rt.Token, DomainName: "a.example.com"})
+		if err != nil {
+			t.Errorf("Expected registration with token to succeed, got [%v]", err)
+		}
+		if reg.RegToken != rt.ID {
+			t.Errorf("Expected record to reference token [%s], got [%s]", rt.ID, reg.RegToken)
+		}
+	}
+	if _, err = DB.RegisterRecord(registration{RegToken: rt.Token, DomainName: "a.example.com"}); err != errInvalidRegToken {
+		t.Errorf("Expected errInvalidRegToken for used up token, got [%v]", err)
+	}
+
+	expired, _ := DB.NewRegToken(Actor{}, RegToken{MaxUses: 1, Expires: time.Now().Add(-time.Minute).Unix()})
+	if _, err = DB.RegisterRecord(registration{RegToken: expired.Token}); err != errInvalidRegToken {
+		t.Errorf("Expected errInvalidRegToken for expired token, got [%v]", err)
+	}
+
+	tokens, err := DB.GetRegTokens(Actor{Admin: "admin"})
+	if err != nil || len(tokens) != 2 {
+		t.Fatalf("Expected [2] registration tokens, got [%d] and error [%v]", len(tokens), err)
+	}
+	for _, listed := range tokens {
+		if listed.Token != "" {
+			t.Errorf("Token value should not be listed")
+		}
+		if listed.ID == rt.ID && listed.Uses != 2 {
+			t.Errorf("Expected token to be used [2] times, got [%d]", listed.Uses)
+		}
+	}
+	if err = DB.DeleteRegToken(Actor{}, rt.ID); err != nil {
+		t.Errorf("Could not delete registration token: [%v]", err)
+	}
+	if err = DB.DeleteRegToken(Actor{}, rt.ID); err != errNoRecord {
+		t.Errorf("Expected errNoRecord when deleting twice, got [%v]", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	reg, err := DB.RegisterRecord(registration{Actor: Actor{IP: "10.0.0.1"}})
+	if err != nil {
+		t.Fatalf("Could not register record: [%v]", err)
+	}
+	owner := Actor{Username: reg.Username, Subdomain: reg.Subdomain, IP: "10.0.0.2"}
+	reg.Value = "tokenvalue_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	if err = DB.Update(owner, reg.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update record: [%v]", err)
+	}
+	reg.Value = ""
+	if err = DB.ClearTXT(owner, reg.ACMETxtPost); err != nil {
+		t.Fatalf("Could not clear record: [%v]", err)
+	}
+	if err = DB.DeleteRecord(Actor{Admin: "ops", IP: "10.0.0.3"}, reg.Subdomain); err != nil {
+		t.Fatalf("Could not delete record: [%v]", err)
+	}
+
+	entries, err := DB.GetAuditLog(AuditQuery{Subdomain: reg.Subdomain})
+	if err != nil {
+		t.Fatalf("Could not get audit log: [%v]", err)
+	}
+	expected := []AuditEntry{
+		{Actor: "admin:ops", IP: "10.0.0.3", Action: auditDelete},
+		{Actor: "user:" + reg.Username.String(), IP: "10.0.0.2", Action: auditClearTXT, OldValue: "tokenvalue_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		{Actor: "user:" + reg.Username.String(), IP: "10.0.0.2", Action: auditUpdateTXT, NewValue: "tokenvalue_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"},
+		{Actor: "anonymous", IP: "10.0.0.1", Action: auditRegister},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected [%d] audit entries, got [%d]", len(expected), len(entries))
+	}
+	for i, e := range expected {
+		got := entries[i]
+		if got.Actor != e.Actor || got.IP != e.IP || got.Action != e.Action || got.OldValue != e.OldValue || got.NewValue != e.NewValue {
+			t.Errorf("Expected audit entry %d to be [%+v], got [%+v]", i, e, got)
+		}
+	}
+
+	page, err := DB.GetAuditLog(AuditQuery{Subdomain: reg.Subdomain, Cursor: entries[1].ID, Limit: 1})
+	if err != nil || len(page) != 1 || page[0].ID != entries[2].ID {
+		t.Errorf("Expected page after cursor to start with entry [%d], got [%v] and error [%v]", entries[2].ID, page, err)
+	}
+	filtered, err := DB.GetAuditLog(AuditQuery{Subdomain: reg.Subdomain, Actor: "admin:ops", Action: auditDelete})
+	if err != nil || len(filtered) != 1 {
+		t.Errorf("Expected [1] filtered audit entry, got [%d] and error [%v]", len(filtered), err)
+	}
+}
+
+func TestTenants(t *testing.T) {
+	superadmin := Actor{Admin: "admin"}
+	team, err := DB.NewTenant(superadmin, "team-a")
+	if err != nil || team.Token == "" {
+		t.Fatalf("Could not create tenant: [%v]", err)
+	}
+	other, _ := DB.NewTenant(superadmin, "team-b")
+	if _, err = DB.NewTenant(superadmin, "team-a"); !isUniqueViolation(err) {
+		t.Errorf("Expected unique violation for duplicate tenant name, got [%v]", err)
+	}
+	found, err := DB.GetTenantByToken(team.Token)
+	if err != nil || found.ID != team.ID {
+		t.Errorf("Expected to find tenant [%s] by token, got [%s] and error [%v]", team.ID, found.ID, err)
+	}
+	if _, err = DB.GetTenantByToken("not-a-token"); err != errNoRecord {
+		t.Errorf("Expected errNoRecord for unknown token, got [%v]", err)
+	}
+
+	teamAdmin := Actor{Admin: team.Name, Tenant: team.ID}
+	otherAdmin := Actor{Admin: other.Name, Tenant: other.ID}
+	reg, err := DB.RegisterRecord(registration{TenantID: team.ID})
+	if err != nil {
+		t.Fatalf("Could not register record for tenant: [%v]", err)
+	}
+	if _, err = DB.RegisterRecord(registration{TenantID: "no-such-tenant"}); err != errNoTenant {
+		t.Errorf("Expected errNoTenant, got [%v]", err)
+	}
+	domains, err := DB.GetDomains(DomainQuery{TenantID: team.ID})
+	if err != nil || len(domains) != 1 || domains[0].Subdomain != reg.Subdomain {
+		t.Errorf("Expected only the record of the tenant, got [%v] and error [%v]", domains, err)
+	}
+	if err = DB.UpdateDomainName(otherAdmin, reg.Subdomain, "example.org"); err != errNoRecord {
+		t.Errorf("Expected errNoRecord for admin of another tenant, got [%v]", err)
+	}
+	if err = DB.UpdateDomainName(teamAdmin, reg.Subdomain, "example.org"); err != nil {
+		t.Errorf("Expected tenant admin to update record of the tenant, got [%v]", err)
+	}
+
+	rt, err := DB.NewRegToken(teamAdmin, RegToken{MaxUses: 1, TenantID: team.ID})
+	if err != nil {
+		t.Fatalf("Could not create registration token: [%v]", err)
+	}
+	tokens, _ := DB.GetRegTokens(otherAdmin)
+	if len(tokens) != 0 {
+		t.Errorf("Expected no registration tokens for another tenant, got [%d]", len(tokens))
+	}
+	if err = DB.DeleteRegToken(otherAdmin, rt.ID); err != errNoRecord {
+		t.Errorf("Expected errNoRecord when deleting token of another tenant, got [%v]", err)
+	}
+	byToken, err := DB.RegisterRecord(registration{RegToken: rt.Token})
+	if err != nil || byToken.TenantID != team.ID {
+		t.Errorf("Expected record registered with token to belong to tenant [%s], got [%s] and error [%v]", team.ID, byToken.TenantID, err)
+	}
+
+	if err = DB.DeleteTenant(superadmin, team.ID); err != errTenantInUse {
+		t.Errorf("Expected errTenantInUse, got [%v]", err)
+	}
+	if err = DB.DeleteTenant(superadmin, other.ID); err != nil {
+		t.Errorf("Could not delete tenant: [%v]", err)
+	}
+	if err = DB.DeleteTenant(superadmin, other.ID); err != errNoRecord {
+		t.Errorf("Expected errNoRecord when deleting twice, got [%v]", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	reg, err := DB.RegisterRecord(registration{Labels: map[string]string{"team": "payments", "env": "prod"}, Note: "billing certs", Owner: "ops@example.com"})
+	if err != nil {
+		t.Fatalf("Could not register record: [%v]", err)
+	}
+	other, _ := DB.RegisterRecord(registration{Labels: map[string]string{"team": "payments", "env": "staging"}})
+
+	domains, err := DB.GetDomains(DomainQuery{Labels: map[string]string{"team": "payments", "env": "prod"}})
+	if err != nil || len(domains) != 1 {
+		t.Fatalf("Expected [1] record with both labels, got [%d] and error [%v]", len(domains), err)
+	}
+	if domains[0].Subdomain != reg.Subdomain || domains[0].Labels["env"] != "prod" || domains[0].Note != "billing certs" || domains[0].Owner != "ops@example.com" {
+		t.Errorf("Unexpected record metadata [%+v]", domains[0])
+	}
+	domains, _ = DB.GetDomains(DomainQuery{Labels: map[string]string{"team": "payments"}})
+	if len(domains) < 2 {
+		t.Errorf("Expected at least [2] records with the label, got [%d]", len(domains))
+	}
+
+	owner := Actor{Username: reg.Username, Subdomain: reg.Subdomain}
+	note := ""
+	labels := map[string]string{"team": "checkout"}
+	rec, err := DB.UpdateMetadata(owner, reg.Subdomain, MetadataUpdate{Labels: &labels, Note: &note})
+	if err != nil {
+		t.Fatalf("Could not update metadata: [%v]", err)
+	}
+	if len(rec.Labels) != 1 || rec.Labels["team"] != "checkout" || rec.Note != "" || rec.Owner != "ops@example.com" {
+		t.Errorf("Unexpected metadata after update [%+v]", rec)
+	}
+	domains, _ = DB.GetDomains(DomainQuery{Labels: map[string]string{"team": "payments", "env": "prod"}})
+	if len(domains) != 0 {
+		t.Errorf("Expected replaced labels to no longer match, got [%d] records", len(domains))
+	}
+	if _, err = DB.UpdateMetadata(owner, other.Subdomain, MetadataUpdate{Note: &note}); err != errNotOwner {
+		t.Errorf("Expected errNotOwner, got [%v]", err)
+	}
+
+	if err = DB.DeleteRecord(owner, reg.Subdomain); err != nil {
+		t.Fatalf("Could not delete record: [%v]", err)
+	}
+	var count int
+	_ = DB.GetBackend().QueryRow("SELECT COUNT(*) FROM labels WHERE Username = ?", reg.Username.String()).Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected labels to be deleted with the record, got [%d]", count)
+	}
+}
+
+func TestGetDomainsPaging(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		if _, err := DB.RegisterRecord(registration{DomainName: "dbpage-" + strconv.Itoa(i) + ".Example.com"}); err != nil {
+			t.Fatalf("Could not register record: [%v]", err)
+		}
+	}
+	q := DomainQuery{Search: "DBPAGE-", SortBy: "created_at", Descending: true, Limit: 2}
+	total, err := DB.CountDomains(q)
+	if err != nil || total != 5 {
+		t.Fatalf("Expected [5] matching records, got [%d] and error [%v]", total, err)
+	}
+	seen := map[string]bool{}
+	var last ACMETxt
+	for page := 0; page < 3; page++ {
+		domains, err := DB.GetDomains(q)
+		if err != nil {
+			t.Fatalf("Could not get domains: [%v]", err)
+		}
+		if page < 2 && len(domains) != 2 || page == 2 && len(domains) != 1 {
+			t.Fatalf("Unexpected number of records [%d] on page %d", len(domains), page)
+		}
+		for _, d := range domains {
+			if seen[d.Subdomain] {
+				t.Errorf("Record [%s] returned twice", d.Subdomain)
+			}
+			seen[d.Subdomain] = true
+			if last.CreatedAt != 0 && d.CreatedAt > last.CreatedAt {
+				t.Errorf("Expected records in descending order of creation")
+			}
+			last = d
+		}
+		q.Cursor = &DomainCursor{Value: last.CreatedAt, Username: last.Username.String()}
+	}
+	if domains, _ := DB.GetDomains(DomainQuery{Search: "dbpage-3.example", Limit: 10}); len(domains) != 1 {
+		t.Errorf("Expected [1] record matching the domain name, got [%d]", len(domains))
+	}
+	if count, _ := DB.CountDomains(DomainQuery{Search: "dbpage_"}); count != 0 {
+		t.Errorf("Expected underscore in search to match literally, got [%d] records", count)
+	}
+}
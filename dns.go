@@ -3,8 +3,10 @@ package main
 import (
 	"fmt"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,6 +23,10 @@ type DNSServer struct {
 	SOA             dns.RR
 	PersonalKeyAuth string
 	Domains         map[string]Records
+	// ProxyProtocol enables PROXY protocol headers on TCP listeners
+	ProxyProtocol bool
+	// Mutex guards Domains and SOA, which are replaced on configuration reload. Read them with records().
+	Mutex sync.RWMutex
 }
 
 // NewDNSServer parses the DNS records from config and returns a new DNSServer struct
@@ -41,8 +47,16 @@ func NewDNSServer(db database, addr string, proto string, domain string) *DNSSer
 func (d *DNSServer) Start(errorChannel chan error) {
 	// DNS server part
 	dns.HandleFunc(".", d.handleRequest)
-	log.WithFields(log.Fields{"addr": d.Server.Addr, "proto": d.Server.Net}).Info("Listening DNS")
-	err := d.Server.ListenAndServe()
+	log.WithFields(log.Fields{"addr": d.Server.Addr, "proto": d.Server.Net, "proxy_protocol": d.ProxyProtocol}).Info("Listening DNS")
+	var err error
+	if d.ProxyProtocol && strings.HasPrefix(d.Server.Net, "tcp") {
+		d.Server.Listener, err = listenTCP(d.Server.Net, d.Server.Addr, true)
+		if err == nil {
+			err = d.Server.ActivateAndServe()
+		}
+	} else {
+		err = d.Server.ListenAndServe()
+	}
 	if err != nil {
 		errorChannel <- err
 	}
@@ -72,6 +86,24 @@ func (d *DNSServer) ParseRecords(config DNSConfig) {
 	}
 }
 
+// ReloadRecords replaces the served records and SOA with the ones parsed from config
+func (d *DNSServer) ReloadRecords(config DNSConfig) {
+	parsed := DNSServer{Domains: make(map[string]Records)}
+	parsed.ParseRecords(config)
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	d.Domains = parsed.Domains
+	d.SOA = parsed.SOA
+}
+
+// records returns the served records and SOA. ReloadRecords replaces the map instead of changing it, so
+// the returned map can be read without holding the lock, eg. while looking up TXT values from the database.
+func (d *DNSServer) records() (map[string]Records, dns.RR) {
+	d.Mutex.RLock()
+	defer d.Mutex.RUnlock()
+	return d.Domains, d.SOA
+}
+
 func (d *DNSServer) appendRR(rr dns.RR) {
 	addDomain := rr.Header().Name
 	_, ok := d.Domains[addDomain]
@@ -125,7 +157,8 @@ func (d *DNSServer) readQuery(m *dns.Msg) {
 	m.MsgHdr.Authoritative = authoritative
 	if authoritative {
 		if m.MsgHdr.Rcode == dns.RcodeNameError {
-			m.Ns = append(m.Ns, d.SOA)
+			_, soa := d.records()
+			m.Ns = append(m.Ns, soa)
 		}
 	}
 }
@@ -133,7 +166,8 @@ func (d *DNSServer) readQuery(m *dns.Msg) {
 func (d *DNSServer) getRecord(q dns.Question) ([]dns.RR, error) {
 	var rr []dns.RR
 	var cnames []dns.RR
-	domain, ok := d.Domains[strings.ToLower(q.Name)]
+	domains, _ := d.records()
+	domain, ok := domains[strings.ToLower(q.Name)]
 	if !ok {
 		return rr, fmt.Errorf("No records for domain %s", q.Name)
 	}
@@ -156,7 +190,8 @@ func (d *DNSServer) answeringForDomain(name string) bool {
 	if d.Domain == strings.ToLower(name) {
 		return true
 	}
-	_, ok := d.Domains[strings.ToLower(name)]
+	domains, _ := d.records()
+	_, ok := domains[strings.ToLower(name)]
 	return ok
 }
 
@@ -214,14 +249,18 @@ func (d *DNSServer) answer(q dns.Question) ([]dns.RR, int, bool, error) {
 		rcode = dns.RcodeSuccess
 	}
 	log.WithFields(log.Fields{"qtype": dns.TypeToString[q.Qtype], "domain": q.Name, "rcode": dns.RcodeToString[rcode]}).Debug("Answering question for domain")
+	dnsQueries.WithLabelValues(qtypeLabel(q.Qtype), dns.RcodeToString[rcode]).Inc()
 	return r, rcode, authoritative, nil
 }
 
 func (d *DNSServer) answerTXT(q dns.Question) ([]dns.RR, error) {
 	var ra []dns.RR
 	subdomain := sanitizeDomainQuestion(q.Name)
+	timer := prometheus.NewTimer(txtLookupDuration)
 	atxt, err := d.DB.GetTXTForDomain(subdomain)
+	timer.ObserveDuration()
 	if err != nil {
+		dbErrors.Inc()
 		log.WithFields(log.Fields{"error": err.Error()}).Debug("Error while trying to get record")
 		return ra, err
 	}
@@ -205,7 +205,7 @@ func TestResolveTXT(t *testing.T) {
 		return
 	}
 	atxt.Value = validTXT
-	err = DB.Update(atxt.ACMETxtPost)
+	err = DB.Update(Actor{}, atxt.ACMETxtPost)
 	if err != nil {
 		t.Errorf("Could not update db record: [%v]", err)
 		return
@@ -256,6 +256,35 @@ func TestResolveTXT(t *testing.T) {
 	}
 }
 
+func TestResolveTXTAfterDelete(t *testing.T) {
+	resolv := resolver{server: "127.0.0.1:15353"}
+	validTXT := "______________valid_response_______________"
+
+	atxt, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Fatalf("Could not initiate db record: [%v]", err)
+	}
+	atxt.Value = validTXT
+	if err = DB.Update(Actor{}, atxt.ACMETxtPost); err != nil {
+		t.Fatalf("Could not update db record: [%v]", err)
+	}
+	answer, err := resolv.lookup(atxt.Subdomain+".auth.example.org", dns.TypeTXT)
+	if err != nil {
+		t.Fatalf("Expected answer but got: %v", err)
+	}
+	if err = hasExpectedTXTAnswer(answer.Answer, validTXT); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	if err = DB.DeleteRecord(Actor{Username: atxt.Username, Subdomain: atxt.Subdomain}, atxt.Subdomain); err != nil {
+		t.Fatalf("Could not delete db record: [%v]", err)
+	}
+	answer, _ = resolv.lookup(atxt.Subdomain+".auth.example.org", dns.TypeTXT)
+	if answer.Rcode != dns.RcodeNameError {
+		t.Errorf("Was expecting NXDOMAIN rcode for deleted record, but got [%s] instead.", dns.RcodeToString[answer.Rcode])
+	}
+}
+
 func TestCaseInsensitiveResolveA(t *testing.T) {
 	resolv := resolver{server: "127.0.0.1:15353"}
 	answer, err := resolv.lookup("aUtH.eXAmpLe.org", dns.TypeA)
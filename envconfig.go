@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// envPrefix is the prefix of the environment variables overriding configuration options
+const envPrefix = "ACMEDNS"
+
+// applyEnvOverrides sets the options of conf from environment variables named ACMEDNS_<SECTION>_<OPTION>
+// after the names in the configuration file, eg. ACMEDNS_DATABASE_CONNECTION. With the _FILE suffix, eg.
+// ACMEDNS_DATABASE_CONNECTION_FILE, the value is read from the named file, like a mounted secret.
+func applyEnvOverrides(conf *DNSConfig) error {
+	return applyEnvSection(reflect.ValueOf(conf).Elem(), envPrefix)
+}
+
+func applyEnvSection(section reflect.Value, prefix string) error {
+	for i := 0; i < section.NumField(); i++ {
+		name := prefix + "_" + strings.ToUpper(settingName(section.Type().Field(i)))
+		field := section.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvSection(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok, err := lookupEnvOption(name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = setOption(field, value); err != nil {
+			return fmt.Errorf("invalid value in %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// lookupEnvOption returns the value of the environment variable or the content of the file named by its _FILE variant
+func lookupEnvOption(name string) (string, bool, error) {
+	value, ok := os.LookupEnv(name)
+	fname, fromFile := os.LookupEnv(name + "_FILE")
+	if ok && fromFile {
+		return "", false, fmt.Errorf("both %s and %s_FILE are set", name, name)
+	}
+	if !fromFile {
+		return value, ok, nil
+	}
+	content, err := os.ReadFile(fname)
+	if err != nil {
+		return "", false, fmt.Errorf("could not read %s_FILE: %w", name, err)
+	}
+	// Files usually end with a newline that is not part of the value
+	return strings.TrimRight(string(content), "\r\n"), true, nil
+}
+
+// setOption parses the value into the option. Lists of strings are either comma separated or TOML arrays,
+// other lists are TOML arrays, eg. [{username = "admin", password = "$2a$10$..."}] for admin users.
+func setOption(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			list := []string{}
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					list = append(list, v)
+				}
+			}
+			field.Set(reflect.ValueOf(list).Convert(field.Type()))
+			return nil
+		}
+		return decodeTOMLValue(field, value)
+	default:
+		return fmt.Errorf("unsupported option type %s", field.Type())
+	}
+	return nil
+}
+
+// decodeTOMLValue parses a TOML value into the option
+func decodeTOMLValue(field reflect.Value, value string) error {
+	holder := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "Value", Type: field.Type(), Tag: `toml:"value"`},
+	}))
+	if _, err := toml.Decode("value = "+value, holder.Interface()); err != nil {
+		return err
+	}
+	field.Set(holder.Elem().Field(0))
+	return nil
+}
+
+// hasEnvConfig checks if any configuration options are set in the environment
+func hasEnvConfig() bool {
+	for _, v := range os.Environ() {
+		if strings.HasPrefix(v, envPrefix+"_") {
+			return true
+		}
+	}
+	return false
+}
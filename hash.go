@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Defaults for the [hashing] configuration section
+const (
+	defaultHashAlgorithm = "bcrypt"
+	defaultBcryptCost    = 10
+	defaultArgon2Time    = 2
+	defaultArgon2Memory  = 19456
+	defaultArgon2Threads = 1
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+	argon2Prefix     = "$argon2id$"
+)
+
+// dummyHashes caches a hash for each hashing configuration, compared against when the user
+// does not exist to protect against timed side channel
+var dummyHashes sync.Map
+
+// argon2Params are the parameters of an argon2id hash
+type argon2Params struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// withDefaults returns the hashing configuration with defaults for unset values, prepareConfig applies it
+// to the configuration, so the hashing functions read Config.Hashing as is
+func (h hashconfig) withDefaults() hashconfig {
+	if h.Algorithm == "" {
+		h.Algorithm = defaultHashAlgorithm
+	}
+	if h.BcryptCost < bcrypt.MinCost {
+		h.BcryptCost = defaultBcryptCost
+	}
+	if h.Argon2Time == 0 {
+		h.Argon2Time = defaultArgon2Time
+	}
+	if h.Argon2Memory == 0 {
+		h.Argon2Memory = defaultArgon2Memory
+	}
+	if h.Argon2Threads == 0 {
+		h.Argon2Threads = defaultArgon2Threads
+	}
+	return h
+}
+
+// hashPassword hashes the password with the configured algorithm
+func hashPassword(pw string) (string, error) {
+	h := Config.Hashing
+	switch h.Algorithm {
+	case "argon2id":
+		salt := make([]byte, argon2SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		return encodeArgon2id([]byte(pw), salt, argon2Params{h.Argon2Time, h.Argon2Memory, h.Argon2Threads}), nil
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword([]byte(pw), h.BcryptCost)
+		return string(hash), err
+	}
+	return "", fmt.Errorf("unknown hash algorithm %s", h.Algorithm)
+}
+
+// needsRehash checks if the hash was made with another algorithm or other parameters than configured
+func needsRehash(hash string) bool {
+	h := Config.Hashing
+	if strings.HasPrefix(hash, argon2Prefix) {
+		params, _, _, err := decodeArgon2id(hash)
+		return err != nil || h.Algorithm != "argon2id" || params != argon2Params{h.Argon2Time, h.Argon2Memory, h.Argon2Threads}
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || h.Algorithm != "bcrypt" || cost != h.BcryptCost
+}
+
+// hashScheme describes the algorithm and parameters of the hash for the audit log, without its salt and key
+func hashScheme(hash string) string {
+	if strings.HasPrefix(hash, argon2Prefix) {
+		if p, _, _, err := decodeArgon2id(hash); err == nil {
+			return fmt.Sprintf("argon2id m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads)
+		}
+	} else if cost, err := bcrypt.Cost([]byte(hash)); err == nil {
+		return fmt.Sprintf("bcrypt cost=%d", cost)
+	}
+	return "unknown"
+}
+
+// validPasswordHash checks if the hash is in a format correctPassword understands
+func validPasswordHash(hash string) bool {
+	if strings.HasPrefix(hash, argon2Prefix) {
+		_, _, _, err := decodeArgon2id(hash)
+		return err == nil
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// dummyPasswordHash returns a hash made with the current hashing configuration
+func dummyPasswordHash() string {
+	h := Config.Hashing
+	if hash, ok := dummyHashes.Load(h); ok {
+		return hash.(string)
+	}
+	hash, err := hashPassword(generatePassword(40))
+	if err != nil {
+		return dummyHash
+	}
+	dummyHashes.Store(h, hash)
+	return hash
+}
+
+// encodeArgon2id hashes the password and returns it in the PHC string format
+func encodeArgon2id(pw []byte, salt []byte, p argon2Params) string {
+	key := argon2.IDKey(pw, salt, p.Time, p.Memory, p.Threads, argon2KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2Prefix, argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// decodeArgon2id parses an argon2id hash in the PHC string format
+func decodeArgon2id(hash string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+	var version int
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	if p.Time == 0 || p.Threads == 0 || len(key) == 0 {
+		return p, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	return p, salt, key, nil
+}
+
+// correctArgon2id compares the password against an argon2id hash
+func correctArgon2id(pw string, hash string) bool {
+	p, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	other := argon2.IDKey([]byte(pw), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
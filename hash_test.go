@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	defer func() { Config.Hashing = hashconfig{}.withDefaults() }()
+	for i, test := range []struct {
+		settings hashconfig
+		prefix   string
+	}{
+		{hashconfig{}, "$2a$10$"},
+		{hashconfig{Algorithm: "bcrypt", BcryptCost: 4}, "$2a$04$"},
+		{hashconfig{Algorithm: "argon2id", Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 2}, "$argon2id$v=19$m=1024,t=1,p=2$"},
+	} {
+		Config.Hashing = test.settings.withDefaults()
+		hash, err := hashPassword("secret")
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error [%v]", i, err)
+		}
+		if !strings.HasPrefix(hash, test.prefix) {
+			t.Errorf("Test %d: Expected hash to start with [%s], got [%s]", i, test.prefix, hash)
+		}
+		if !correctPassword("secret", hash) {
+			t.Errorf("Test %d: Expected password to match the hash", i)
+		}
+		if correctPassword("wrong", hash) {
+			t.Errorf("Test %d: Expected wrong password not to match the hash", i)
+		}
+		if !validPasswordHash(hash) {
+			t.Errorf("Test %d: Expected hash to be valid", i)
+		}
+		if needsRehash(hash) {
+			t.Errorf("Test %d: Expected fresh hash not to need a rehash", i)
+		}
+	}
+	Config.Hashing = hashconfig{Algorithm: "md5"}
+	if _, err := hashPassword("secret"); err == nil {
+		t.Errorf("Expected error for unknown algorithm")
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	defer func() { Config.Hashing = hashconfig{}.withDefaults() }()
+	argon := "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$ZXhhbXBsZWtleWV4YW1wbGVrZXlleGFtcGxla2V5"
+	for i, test := range []struct {
+		settings hashconfig
+		hash     string
+		expected bool
+	}{
+		{hashconfig{}, dummyHash, false},
+		{hashconfig{BcryptCost: 12}, dummyHash, true},
+		{hashconfig{Algorithm: "argon2id"}, dummyHash, true},
+		{hashconfig{Algorithm: "argon2id", Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}, argon, false},
+		{hashconfig{Algorithm: "argon2id", Argon2Time: 2, Argon2Memory: 1024, Argon2Threads: 1}, argon, true},
+		{hashconfig{}, argon, true},
+		{hashconfig{}, "garbage", true},
+	} {
+		Config.Hashing = test.settings.withDefaults()
+		if ret := needsRehash(test.hash); ret != test.expected {
+			t.Errorf("Test %d: Expected [%t], got [%t]", i, test.expected, ret)
+		}
+	}
+}
+
+func TestValidPasswordHash(t *testing.T) {
+	for i, test := range []struct {
+		hash     string
+		expected bool
+	}{
+		{dummyHash, true},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$ZXhhbXBsZWtleWV4YW1wbGVrZXlleGFtcGxla2V5", true},
+		{"$argon2id$v=18$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$ZXhhbXBsZWtleWV4YW1wbGVrZXlleGFtcGxla2V5", false},
+		{"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$ZXhhbXBsZWtleWV4YW1wbGVrZXlleGFtcGxla2V5", false},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA", false},
+		{"$argon2i$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$ZXhhbXBsZWtleWV4YW1wbGVrZXlleGFtcGxla2V5", false},
+		{"plaintext", false},
+	} {
+		if ret := validPasswordHash(test.hash); ret != test.expected {
+			t.Errorf("Test %d: Expected [%t], got [%t]", i, test.expected, ret)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// healthCheckTimeout bounds the time of the readiness checks
+const healthCheckTimeout = 2 * time.Second
+
+// HealthStatus is the health endpoint response JSON, Checks holds "ok" or the error of each readiness check
+type HealthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// readiness checks that the dependencies needed for serving requests are working
+type readiness struct {
+	dnsservers []*DNSServer
+	// certificate checks the API certificate, nil when the API is served without TLS
+	certificate func() error
+}
+
+// check runs the readiness checks and reports if all of them passed
+func (rd *readiness) check(ctx context.Context) (HealthStatus, bool) {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	results := map[string]error{"database": checkDatabase(ctx)}
+	for _, d := range rd.dnsservers {
+		results["dns:"+d.Server.Net+":"+d.Server.Addr] = checkDNSServer(ctx, d)
+	}
+	if rd.certificate != nil {
+		results["certificate"] = rd.certificate()
+	}
+	status := HealthStatus{Status: "ok", Checks: make(map[string]string)}
+	for name, err := range results {
+		if err != nil {
+			status.Status = "error"
+			status.Checks[name] = err.Error()
+			continue
+		}
+		status.Checks[name] = "ok"
+	}
+	return status, status.Status == "ok"
+}
+
+// webHealthReady responds with 200 when the server is ready to serve requests and with 503 otherwise
+func (rd *readiness) webHealthReady(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	status, ok := rd.check(r.Context())
+	code := http.StatusOK
+	if !ok {
+		log.WithFields(log.Fields{"checks": status.Checks}).Warning("Readiness check failed")
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, status)
+}
+
+// webHealthLive responds as long as the API is able to handle requests
+func webHealthLive(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeHealth(w, http.StatusOK, HealthStatus{Status: "ok"})
+}
+
+func writeHealth(w http.ResponseWriter, code int, status HealthStatus) {
+	resp, err := json.Marshal(status)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(resp)
+}
+
+func checkDatabase(ctx context.Context) error {
+	if DB == nil || DB.GetBackend() == nil {
+		return errors.New("database not open")
+	}
+	return DB.GetBackend().PingContext(ctx)
+}
+
+// checkDNSServer queries the SOA of the served domain from the listener of the DNS server
+func checkDNSServer(ctx context.Context, d *DNSServer) error {
+	m := new(dns.Msg)
+	m.SetQuestion(d.Domain, dns.TypeSOA)
+	c := dns.Client{Net: d.Server.Net, Timeout: healthCheckTimeout}
+	_, _, err := c.ExchangeContext(ctx, m, localDNSAddr(d.Server.Addr, d.Server.Net))
+	return err
+}
+
+// localDNSAddr returns the address to reach a DNS listener from the host itself, listeners on all
+// interfaces are reached through the loopback interface
+func localDNSAddr(addr string, network string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if strings.HasSuffix(network, "6") || (ip != nil && ip.To4() == nil) {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// keyPairCheck returns a certificate check for a key pair loaded from files
+func keyPairCheck(cert tls.Certificate) (func() error, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate in key pair")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		if time.Now().After(leaf.NotAfter) {
+			return fmt.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+		}
+		return nil
+	}, nil
+}
+
+// managedCertificateCheck returns a certificate check for a certificate obtained by certmagic
+func managedCertificateCheck(cache *certmagic.Cache, domain string) func() error {
+	return func() error {
+		for _, cert := range cache.AllMatchingCertificates(domain) {
+			if !cert.Expired() {
+				return nil
+			}
+		}
+		return fmt.Errorf("no valid certificate loaded for %s", domain)
+	}
+}
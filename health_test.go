@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getReadiness(t *testing.T, rd *readiness) (int, HealthStatus) {
+	w := httptest.NewRecorder()
+	rd.webHealthReady(w, httptest.NewRequest(http.MethodGet, "/health/ready", nil), nil)
+	var status HealthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Could not decode response [%v]", err)
+	}
+	return w.Code, status
+}
+
+func TestHealthLive(t *testing.T) {
+	w := httptest.NewRecorder()
+	webHealthLive(w, httptest.NewRequest(http.MethodGet, "/health/live", nil), nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	code, status := getReadiness(t, &readiness{dnsservers: []*DNSServer{dnsserver}})
+	if code != http.StatusOK || status.Status != "ok" {
+		t.Errorf("Expected ready server, got %d %v", code, status)
+	}
+	for _, name := range []string{"database", "dns:udp:127.0.0.1:15353"} {
+		if status.Checks[name] != "ok" {
+			t.Errorf("Expected check %s to pass, got [%s]", name, status.Checks[name])
+		}
+	}
+	if _, ok := status.Checks["certificate"]; ok {
+		t.Errorf("Expected no certificate check without TLS")
+	}
+}
+
+func TestHealthReadyFailures(t *testing.T) {
+	down := NewDNSServer(DB, "127.0.0.1:15354", "tcp", "auth.example.org")
+	rd := &readiness{
+		dnsservers:  []*DNSServer{dnsserver, down},
+		certificate: func() error { return errors.New("no certificate") },
+	}
+	code, status := getReadiness(t, rd)
+	if code != http.StatusServiceUnavailable || status.Status != "error" {
+		t.Errorf("Expected status 503, got %d %v", code, status)
+	}
+	if status.Checks["dns:udp:127.0.0.1:15353"] != "ok" {
+		t.Errorf("Expected running DNS server to pass, got [%s]", status.Checks["dns:udp:127.0.0.1:15353"])
+	}
+	if status.Checks["dns:tcp:127.0.0.1:15354"] == "ok" {
+		t.Errorf("Expected DNS server that is not listening to fail")
+	}
+	if status.Checks["certificate"] != "no certificate" {
+		t.Errorf("Expected certificate check to fail, got [%s]", status.Checks["certificate"])
+	}
+}
+
+func TestHealthReadyDatabaseDown(t *testing.T) {
+	closed, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Could not open database [%v]", err)
+	}
+	_ = closed.Close()
+	oldDb := DB.GetBackend()
+	DB.SetBackend(closed)
+	defer DB.SetBackend(oldDb)
+
+	code, status := getReadiness(t, &readiness{})
+	if code != http.StatusServiceUnavailable || status.Checks["database"] == "ok" {
+		t.Errorf("Expected database check to fail, got %d %v", code, status)
+	}
+}
+
+func TestLocalDNSAddr(t *testing.T) {
+	for i, test := range []struct {
+		addr     string
+		network  string
+		expected string
+	}{
+		{"127.0.0.1:53", "udp", "127.0.0.1:53"},
+		{"0.0.0.0:53", "udp", "127.0.0.1:53"},
+		{":53", "tcp", "127.0.0.1:53"},
+		{":53", "tcp6", "[::1]:53"},
+		{"[::]:53", "both", "[::1]:53"},
+		{"[2001:db8::1]:53", "udp6", "[2001:db8::1]:53"},
+	} {
+		if ret := localDNSAddr(test.addr, test.network); ret != test.expected {
+			t.Errorf("Test %d: Expected [%s], got [%s]", i, test.expected, ret)
+		}
+	}
+}
+
+func TestKeyPairCheck(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key [%v]", err)
+	}
+	for i, test := range []struct {
+		notAfter time.Time
+		valid    bool
+	}{
+		{time.Now().Add(time.Hour), true},
+		{time.Now().Add(-time.Hour), false},
+	} {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 1)),
+			Subject:      pkix.Name{CommonName: "auth.example.org"},
+			NotBefore:    time.Now().Add(-2 * time.Hour),
+			NotAfter:     test.notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatalf("Could not create certificate [%v]", err)
+		}
+		check, err := keyPairCheck(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key})
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error [%v]", i, err)
+		}
+		if err = check(); (err == nil) != test.valid {
+			t.Errorf("Test %d: Expected valid %t, got error [%v]", i, test.valid, err)
+		}
+	}
+	if _, err = keyPairCheck(tls.Certificate{}); err == nil {
+		t.Errorf("Expected error for empty key pair")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// janitorInterval is how often expired TXT values are cleared from the database
+const janitorInterval = time.Minute
+
+// runTXTJanitor clears TXT values older than maxAge every interval until the context is done
+func runTXTJanitor(ctx context.Context, db database, maxAge time.Duration, interval time.Duration) {
+	log.WithFields(log.Fields{"maxage": maxAge.String()}).Info("Starting TXT janitor")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expireTXT(db, maxAge)
+		}
+	}
+}
+
+// expireTXT clears TXT values older than maxAge and logs what was cleared
+func expireTXT(db database, maxAge time.Duration) {
+	cleared, err := db.ExpireTXT(time.Now().Add(-maxAge).Unix())
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error while clearing expired TXT values")
+		return
+	}
+	for _, txt := range cleared {
+		log.WithFields(log.Fields{"subdomain": txt.Subdomain, "txt": txt.Value}).Info("Cleared expired TXT value")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpireTXT(t *testing.T) {
+	validTXT := "______________valid_response_______________"
+	reg, err := DB.Register(cidrslice{})
+	if err != nil {
+		t.Fatalf("Registration failed, got error [%v]", err)
+	}
+	reg.Value = validTXT
+	_ = DB.Update(Actor{}, reg.ACMETxtPost)
+
+	Config.General.TXTTTLMinutes = 10
+	defer func() { Config.General.TXTTTLMinutes = 0 }()
+	txts, _ := DB.GetTXTForDomain(reg.Subdomain)
+	if len(txts) == 0 {
+		t.Errorf("Expected fresh TXT value to be served")
+	}
+
+	// Age the value past the max age
+	updSQL := "UPDATE txt SET LastUpdate=$1 WHERE Subdomain=$2 AND Value=$3"
+	if Config.Database.Engine == "sqlite3" {
+		updSQL = getSQLiteStmt(updSQL)
+	}
+	_, err = DB.GetBackend().Exec(updSQL, time.Now().Add(-time.Hour).Unix(), reg.Subdomain, validTXT)
+	if err != nil {
+		t.Fatalf("Could not age TXT value: [%v]", err)
+	}
+	txts, _ = DB.GetTXTForDomain(reg.Subdomain)
+	for _, v := range txts {
+		if v == validTXT {
+			t.Errorf("Expired TXT value should not be served")
+		}
+	}
+
+	loghook.Reset()
+	expireTXT(DB, 10*time.Minute)
+	if !loggerHasEntryWithMessage("Cleared expired TXT value") {
+		t.Errorf("Expected janitor to log the cleared value")
+	}
+	Config.General.TXTTTLMinutes = 0
+	txts, _ = DB.GetTXTForDomain(reg.Subdomain)
+	for _, v := range txts {
+		if v == validTXT {
+			t.Errorf("Expired TXT value should have been cleared")
+		}
+	}
+}
+
+func TestRunTXTJanitorStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runTXTJanitor(ctx, DB, time.Minute, time.Millisecond)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected janitor to stop when the context is done")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// lockoutSweepInterval is how often expired lockout entries are dropped
+const lockoutSweepInterval = time.Minute
+
+// lockouts tracks failed authentication attempts of the API
+var lockouts = newLockoutTracker()
+
+// Lockout is the failed authentication state of a username or a client IP
+type Lockout struct {
+	Kind        string `json:"kind"`
+	Value       string `json:"value"`
+	Failures    int    `json:"failures"`
+	LastFailure int64  `json:"last_failure"`
+	LockedUntil int64  `json:"locked_until"`
+}
+
+type lockoutKey struct {
+	kind  string
+	value string
+}
+
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// lockoutTracker keeps failed authentication counters in memory, per username and per client IP
+type lockoutTracker struct {
+	Mutex     sync.Mutex
+	entries   map[lockoutKey]*lockoutEntry
+	lastSweep time.Time
+}
+
+func newLockoutTracker() *lockoutTracker {
+	return &lockoutTracker{entries: make(map[lockoutKey]*lockoutEntry), lastSweep: time.Now()}
+}
+
+// lockoutDuration returns how long to lock out after the given number of consecutive failures,
+// doubling with every failure past the threshold
+func lockoutDuration(failures int) time.Duration {
+	cfg := Config.Lockout
+	if cfg.Threshold < 1 || failures < cfg.Threshold {
+		return 0
+	}
+	max := time.Duration(cfg.MaxMinutes) * time.Minute
+	d := time.Duration(cfg.BaseSeconds) * time.Second
+	for i := cfg.Threshold; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// lockedFor returns the remaining lockout time of the most restricted of the keys
+func (l *lockoutTracker) lockedFor(now time.Time, keys ...lockoutKey) time.Duration {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	var wait time.Duration
+	for _, k := range keys {
+		if e, ok := l.entries[k]; ok && e.lockedUntil.Sub(now) > wait {
+			wait = e.lockedUntil.Sub(now)
+		}
+	}
+	return wait
+}
+
+// fail records a failed authentication attempt for each of the keys
+func (l *lockoutTracker) fail(now time.Time, keys ...lockoutKey) {
+	if Config.Lockout.Threshold < 1 {
+		return
+	}
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if now.Sub(l.lastSweep) > lockoutSweepInterval {
+		l.sweep(now)
+	}
+	for _, k := range keys {
+		e, ok := l.entries[k]
+		if !ok {
+			e = &lockoutEntry{}
+			l.entries[k] = e
+		}
+		e.failures++
+		e.lastFailure = now
+		if d := lockoutDuration(e.failures); d > 0 {
+			e.lockedUntil = now.Add(d)
+			log.WithFields(log.Fields{"kind": k.kind, "value": k.value, "failures": e.failures, "duration": d.String()}).Warning("Locked out after failed authentication attempts")
+		}
+	}
+}
+
+// succeed resets the counters of the keys after a successful authentication
+func (l *lockoutTracker) succeed(keys ...lockoutKey) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	for _, k := range keys {
+		delete(l.entries, k)
+	}
+}
+
+// decay takes back one failure of each of the keys after a successful authentication. Used for client IPs,
+// which many clients behind a NAT may share, so that their successes keep them from locking each other out.
+func (l *lockoutTracker) decay(keys ...lockoutKey) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	for _, k := range keys {
+		if e, ok := l.entries[k]; ok {
+			e.failures--
+			if e.failures < 1 {
+				delete(l.entries, k)
+			}
+		}
+	}
+}
+
+// sweep drops the entries that are not locked out and have not failed for the longest lockout time
+func (l *lockoutTracker) sweep(now time.Time) {
+	forget := time.Duration(Config.Lockout.MaxMinutes) * time.Minute
+	for k, e := range l.entries {
+		if now.After(e.lockedUntil) && now.Sub(e.lastFailure) > forget {
+			delete(l.entries, k)
+		}
+	}
+	l.lastSweep = now
+}
+
+// list returns the tracked entries, locked out ones first
+func (l *lockoutTracker) list() []Lockout {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	ret := []Lockout{}
+	for k, e := range l.entries {
+		lo := Lockout{Kind: k.kind, Value: k.value, Failures: e.failures, LastFailure: e.lastFailure.Unix()}
+		if !e.lockedUntil.IsZero() {
+			lo.LockedUntil = e.lockedUntil.Unix()
+		}
+		ret = append(ret, lo)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].LockedUntil != ret[j].LockedUntil {
+			return ret[i].LockedUntil > ret[j].LockedUntil
+		}
+		return ret[i].Kind+ret[i].Value < ret[j].Kind+ret[j].Value
+	})
+	return ret
+}
+
+// clear removes the entry of key and reports whether it existed
+func (l *lockoutTracker) clear(k lockoutKey) bool {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	_, ok := l.entries[k]
+	delete(l.entries, k)
+	return ok
+}
+
+// webGetLockouts lists the failed authentication counters, the route is wrapped in SuperadminAuth
+func webGetLockouts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resp, err := json.Marshal(lockouts.list())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// webDeleteLockout clears the lockout of a username, an admin user or a client IP, the route is wrapped in SuperadminAuth
+func webDeleteLockout(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	k := lockoutKey{kind: p.ByName("kind"), value: p.ByName("value")}
+	if k.kind != "user" && k.kind != "admin" && k.kind != "ip" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_kind"))
+		return
+	}
+	if !lockouts.clear(k) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	log.WithFields(log.Fields{"kind": k.kind, "value": k.value, "admin": actor.Admin}).Info("Cleared lockout")
+	w.Header().Set("Content-Type", "application/json")
+	resp, _ := json.Marshal(map[string]string{"kind": k.kind, "value": k.value})
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	Config.Lockout = lockoutconfig{Threshold: 3, BaseSeconds: 30, MaxMinutes: 2}
+	defer func() { Config.Lockout = lockoutconfig{} }()
+	for i, test := range []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, 30 * time.Second},
+		{4, time.Minute},
+		{5, 2 * time.Minute},
+		{6, 2 * time.Minute},
+		{100, 2 * time.Minute},
+	} {
+		if ret := lockoutDuration(test.failures); ret != test.expected {
+			t.Errorf("Test %d: Expected [%s], got [%s]", i, test.expected, ret)
+		}
+	}
+	Config.Lockout.Threshold = 0
+	if ret := lockoutDuration(100); ret != 0 {
+		t.Errorf("Expected no lockout when disabled, got [%s]", ret)
+	}
+}
+
+func TestLockoutTracker(t *testing.T) {
+	Config.Lockout = lockoutconfig{Threshold: 2, BaseSeconds: 10, MaxMinutes: 1}
+	defer func() { Config.Lockout = lockoutconfig{} }()
+	l := newLockoutTracker()
+	now := time.Now()
+	user := lockoutKey{kind: "user", value: "a097455b-52cc-4569-90c8-7a4b97c6eba8"}
+	ip := lockoutKey{kind: "ip", value: "10.0.0.1"}
+	other := lockoutKey{kind: "ip", value: "10.0.0.2"}
+
+	l.fail(now, user, ip)
+	if wait := l.lockedFor(now, user, ip); wait != 0 {
+		t.Errorf("Expected no lockout below threshold, got [%s]", wait)
+	}
+	l.fail(now, user, ip)
+	if wait := l.lockedFor(now, user); wait != 10*time.Second {
+		t.Errorf("Expected user to be locked out for [10s], got [%s]", wait)
+	}
+	if wait := l.lockedFor(now, other); wait != 0 {
+		t.Errorf("Expected other IP not to be locked out, got [%s]", wait)
+	}
+	if wait := l.lockedFor(now.Add(11*time.Second), user, ip); wait != 0 {
+		t.Errorf("Expected lockout to expire, got [%s]", wait)
+	}
+	if len(l.list()) != 2 || l.list()[0].Failures != 2 {
+		t.Errorf("Expected [2] entries with [2] failures, got [%v]", l.list())
+	}
+
+	l.succeed(user)
+	if wait := l.lockedFor(now, user); wait != 0 {
+		t.Errorf("Expected success to reset the user, got [%s]", wait)
+	}
+	if !l.clear(ip) || l.clear(ip) {
+		t.Errorf("Expected IP to be cleared once")
+	}
+
+	// Successes from a shared IP take back its failures one at a time
+	l.fail(now, other)
+	l.fail(now, other)
+	l.decay(other)
+	if len(l.list()) != 1 || l.list()[0].Failures != 1 {
+		t.Errorf("Expected [1] failure left after decay, got [%v]", l.list())
+	}
+	l.decay(other)
+	l.decay(ip)
+	if len(l.list()) != 0 {
+		t.Errorf("Expected decayed entry to be dropped, got [%v]", l.list())
+	}
+
+	// Old entries are forgotten
+	l.fail(now, other)
+	l.fail(now.Add(3*time.Minute), user)
+	if len(l.list()) != 1 {
+		t.Errorf("Expected old entries to be swept, got [%v]", l.list())
+	}
+}
@@ -10,16 +10,21 @@ import (
 	stdlog "log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	legolog "github.com/go-acme/lego/v3/log"
 	"github.com/julienschmidt/httprouter"
-	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 )
 
+// shutdownTimeout is how long the requests in flight may take to finish when stopping
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	// Created files are not world writable
 	syscall.Umask(0077)
@@ -27,16 +32,21 @@ func main() {
 	flag.Parse()
 	// Read global config
 	var err error
+	var configFile string
 	if fileIsAccessible(*configPtr) {
-		log.WithFields(log.Fields{"file": *configPtr}).Info("Using config file")
-		Config, err = readConfig(*configPtr)
+		configFile = *configPtr
 	} else if fileIsAccessible("./config.cfg") {
-		log.WithFields(log.Fields{"file": "./config.cfg"}).Info("Using config file")
-		Config, err = readConfig("./config.cfg")
-	} else {
+		configFile = "./config.cfg"
+	} else if !hasEnvConfig() {
 		log.Errorf("Configuration file not found.")
 		os.Exit(1)
 	}
+	if configFile != "" {
+		log.WithFields(log.Fields{"file": configFile}).Info("Using config file")
+	} else {
+		log.Info("Configuration file not found, using the configuration from environment variables")
+	}
+	Config, err = readConfig(configFile)
 	if err != nil {
 		log.Errorf("Encountered an error while trying to read configuration file:  %s", err)
 		os.Exit(1)
@@ -54,7 +64,13 @@ func main() {
 		log.Info("Connected to database")
 	}
 	DB = newDB
-	defer DB.Close()
+
+	// Stop on SIGINT and SIGTERM, letting the work in flight finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Reload the configuration on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	// Error channel for servers
 	errChan := make(chan error, 1)
@@ -76,6 +92,7 @@ func main() {
 		dnsservers = append(dnsservers, dnsServerUDP)
 		dnsServerUDP.ParseRecords(Config)
 		dnsServerTCP := NewDNSServer(DB, Config.General.Listen, tcpProto, Config.General.Domain)
+		dnsServerTCP.ProxyProtocol = Config.General.ProxyProtocol
 		dnsservers = append(dnsservers, dnsServerTCP)
 		// No need to parse records from config again
 		dnsServerTCP.Domains = dnsServerUDP.Domains
@@ -84,53 +101,142 @@ func main() {
 		go dnsServerTCP.Start(errChan)
 	} else {
 		dnsServer := NewDNSServer(DB, Config.General.Listen, Config.General.Proto, Config.General.Domain)
+		dnsServer.ProxyProtocol = Config.General.ProxyProtocol
 		dnsservers = append(dnsservers, dnsServer)
 		dnsServer.ParseRecords(Config)
 		go dnsServer.Start(errChan)
 	}
 
+	// Clear expired TXT values
+	var janitor sync.WaitGroup
+	if Config.General.TXTTTLMinutes > 0 {
+		janitor.Add(1)
+		go func() {
+			defer janitor.Done()
+			runTXTJanitor(ctx, DB, time.Duration(Config.General.TXTTTLMinutes)*time.Minute, janitorInterval)
+		}()
+	}
+
 	// HTTP API
-	go startHTTPAPI(errChan, Config, dnsservers)
+	httpservers := make([]*http.Server, 0)
+	if Config.Metrics.Enabled && Config.Metrics.Listen != "" {
+		httpservers = append(httpservers, startMetrics(errChan, Config.Metrics.Listen))
+	}
+	exitCode := 0
+	rl := &reloadable{dnsservers: dnsservers}
+	srv, err := startHTTPAPI(errChan, Config, rl)
+	if err != nil {
+		log.Errorf("Could not start HTTP API [%v]", err)
+		exitCode = 1
+	} else {
+		httpservers = append(httpservers, srv)
+		// block waiting for a signal or an error
+	wait:
+		for {
+			select {
+			case <-hup:
+				if err = rl.reload(configFile); err != nil {
+					log.WithFields(log.Fields{"file": configFile, "error": err.Error()}).Error("Configuration not reloaded")
+					continue
+				}
+				log.WithFields(log.Fields{"file": configFile}).Info("Reloaded configuration")
+			case <-ctx.Done():
+				log.Info("Shutting down")
+				break wait
+			case err = <-errChan:
+				log.Errorf("Shutting down after error [%v]", err)
+				exitCode = 1
+				break wait
+			}
+		}
+	}
+	// Stops the janitor also when shutting down after an error
+	stop()
 
-	// block waiting for error
-	for {
-		err = <-errChan
-		if err != nil {
-			log.Fatal(err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	shutdown(shutdownCtx, httpservers, dnsservers)
+	cancel()
+	// The database is closed only after the last users of it have stopped
+	janitor.Wait()
+	DB.Close()
+	log.Info("Stopped")
+	os.Exit(exitCode)
+}
+
+// shutdown stops the servers from accepting new connections and waits for the requests in flight
+// to be answered, until the context is done
+func shutdown(ctx context.Context, httpservers []*http.Server, dnsservers []*DNSServer) {
+	for _, srv := range httpservers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "host": srv.Addr}).Error("Error while shutting down HTTP server")
+		}
+	}
+	for _, d := range dnsservers {
+		if err := d.Server.ShutdownContext(ctx); err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "addr": d.Server.Addr, "proto": d.Server.Net}).Error("Error while shutting down DNS server")
 		}
 	}
 }
 
-func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer) {
+// startMetrics serves the metrics on their own plain HTTP listener
+func startMetrics(errChan chan error, host string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler)
+	srv := &http.Server{Addr: host, Handler: mux}
+	go func() {
+		log.WithFields(log.Fields{"host": host}).Info("Listening HTTP for metrics")
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			errChan <- err
+		}
+	}()
+	return srv
+}
+
+// startHTTPAPI sets up the API server and serves it in the background, errors while serving are sent to errChan.
+// The parts of the server following configuration reloads are set in rl.
+func startHTTPAPI(errChan chan error, config DNSConfig, rl *reloadable) (*http.Server, error) {
 	// Setup http logger
 	logger := log.New()
 	logwriter := logger.Writer()
-	defer logwriter.Close()
 	// Setup logging for different dependencies to log with logrus
 	// Certmagic
 	stdlog.SetOutput(logwriter)
 	// Lego
 	legolog.Logger = logger
 
-	api := httprouter.New()
-	c := cors.New(cors.Options{
-		AllowedOrigins:     Config.API.CorsOrigins,
-		AllowedMethods:     []string{"GET", "POST"},
-		OptionsPassthrough: false,
-		Debug:              Config.General.Debug,
-	})
-	if Config.General.Debug {
-		// Logwriter for saner log output
-		c.Log = stdlog.New(logwriter, "", 0)
-	}
-	if !Config.API.DisableRegistration {
-		api.POST("/register", webRegisterPost)
-	}
-	api.POST("/update", Auth(webUpdatePost))
-	api.GET("/domains", webGetDomains)
+	api := newAPIRouter()
+	ready := &readiness{dnsservers: rl.dnsservers}
+	registerLimit := newRateLimiter(Config.RateLimit.Register)
+	updateLimit := newRateLimiter(Config.RateLimit.Update)
+	// With registration disabled the handler still accepts registration tokens
+	api.POST("/register", RateLimit(registerLimit, webRegisterPost))
+	api.POST("/update", RateLimit(updateLimit, Auth(webUpdatePost)))
+	api.DELETE("/update", RateLimit(updateLimit, Auth(webUpdateDelete)))
+	api.GET("/domains", AdminAuth(webGetDomains))
+	api.DELETE("/domains/:subdomain", ActorAuth(webDeleteDomain))
+	api.PATCH("/domains/:subdomain/allowfrom", ActorAuth(webUpdateAllowFrom))
+	api.PATCH("/domains/:subdomain/txtslots", AdminAuth(webUpdateTXTSlots))
+	api.PATCH("/domains/:subdomain", ActorAuth(webUpdateMetadata))
 	api.GET("/health", healthCheck)
+	api.GET("/health/live", webHealthLive)
+	api.GET("/health/ready", ready.webHealthReady)
 	api.POST("/dnscheck", webDNSCheck)
-	api.POST("/updatename", webUpdateName)
+	api.POST("/updatename", ActorAuth(webUpdateName))
+	api.POST("/rotate", ActorAuth(webRotatePost))
+	api.POST("/regtokens", AdminAuth(webRegTokenPost))
+	api.GET("/regtokens", AdminAuth(webGetRegTokens))
+	api.DELETE("/regtokens/:id", AdminAuth(webDeleteRegToken))
+	api.GET("/lockouts", SuperadminAuth(webGetLockouts))
+	api.DELETE("/lockouts/:kind/:value", SuperadminAuth(webDeleteLockout))
+	api.GET("/audit", AdminAuth(webGetAudit))
+	api.POST("/tenants", SuperadminAuth(webTenantPost))
+	api.GET("/tenants", SuperadminAuth(webGetTenants))
+	api.POST("/tenants/:id/token", SuperadminAuth(webTenantTokenPost))
+	api.DELETE("/tenants/:id", SuperadminAuth(webDeleteTenant))
+	if Config.Metrics.Enabled && Config.Metrics.Listen == "" {
+		api.GET("/metrics", SuperadminAuth(webGetMetrics))
+	}
 	
 	// Optional: Serve UI if directory exists  
 	uiPath := "/usr/share/acme-dns-ui"
@@ -216,7 +322,7 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 	cfg := &tls.Config{
 		MinVersion: tls.VersionTLS12,
 	}
-	provider := NewChallengeProvider(dnsservers)
+	provider := NewChallengeProvider(rl.dnsservers)
 	storage := certmagic.FileStorage{Path: Config.API.ACMECacheDir}
 
 	// Set up certmagic for getting certificate for acme-dns api
@@ -239,53 +345,53 @@ func startHTTPAPI(errChan chan error, config DNSConfig, dnsservers []*DNSServer)
 	})
 
 	magic := certmagic.New(magicCache, *magicConf)
-	var err error
+	ln, err := listenTCP("tcp", host, Config.API.ProxyProtocol)
+	if err != nil {
+		return nil, err
+	}
+	rl.api = newCORSHandler(handler, stdlog.New(logwriter, "", 0), Config)
+	srv := &http.Server{
+		Addr:     host,
+		Handler:  rl.api,
+		ErrorLog: stdlog.New(logwriter, "", 0),
+	}
 	switch Config.API.TLS {
-	case "letsencryptstaging":
+	case "letsencryptstaging", "letsencrypt":
 		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
 		if err != nil {
-			errChan <- err
-			return
+			_ = ln.Close()
+			return nil, err
 		}
 		cfg.GetCertificate = magic.GetCertificate
-
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(handler),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
+		ready.certificate = managedCertificateCheck(magicCache, Config.General.Domain)
+		srv.TLSConfig = cfg
 		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
-	case "letsencrypt":
-		err = magic.ManageAsync(context.Background(), []string{Config.General.Domain})
-		if err != nil {
-			errChan <- err
-			return
-		}
-		cfg.GetCertificate = magic.GetCertificate
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(handler),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
-		}
-		log.WithFields(log.Fields{"host": host, "domain": Config.General.Domain}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS("", "")
 	case "cert":
-		srv := &http.Server{
-			Addr:      host,
-			Handler:   c.Handler(handler),
-			TLSConfig: cfg,
-			ErrorLog:  stdlog.New(logwriter, "", 0),
+		// Loaded here instead of by ServeTLS to be replaceable on reload
+		rl.certs = &certificateFiles{}
+		err = rl.certs.load(Config.API.TLSCertFullchain, Config.API.TLSCertPrivkey)
+		if err != nil {
+			_ = ln.Close()
+			return nil, err
 		}
+		cfg.GetCertificate = rl.certs.GetCertificate
+		ready.certificate = rl.certs.Check
+		srv.TLSConfig = cfg
 		log.WithFields(log.Fields{"host": host}).Info("Listening HTTPS")
-		err = srv.ListenAndServeTLS(Config.API.TLSCertFullchain, Config.API.TLSCertPrivkey)
 	default:
 		log.WithFields(log.Fields{"host": host}).Info("Listening HTTP")
-		err = http.ListenAndServe(host, c.Handler(handler))
-	}
-	if err != nil {
-		errChan <- err
 	}
+	go func() {
+		defer logwriter.Close()
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			errChan <- err
+		}
+	}()
+	return srv, nil
 }
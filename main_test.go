@@ -91,6 +91,7 @@ func setupConfig() {
 		Database: dbcfg,
 		General:  generalcfg,
 		API:      httpapicfg,
+		Hashing:  hashconfig{}.withDefaults(),
 	}
 
 	Config = dnscfg
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Limits of the descriptive metadata of a record
+const (
+	maxLabels          = 64
+	maxLabelValueChars = 255
+	maxNoteChars       = 1024
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/-]{0,62}$`)
+
+// MetadataUpdate holds the descriptive fields of a record to change, nil fields are left as they are.
+// Labels replace all existing labels of the record.
+type MetadataUpdate struct {
+	Labels *map[string]string `json:"labels"`
+	Note   *string            `json:"note"`
+	Owner  *string            `json:"owner"`
+}
+
+// validLabels checks the label names and the length of the values
+func validLabels(labels map[string]string) bool {
+	if len(labels) > maxLabels {
+		return false
+	}
+	for name, value := range labels {
+		if !labelNameRegexp.MatchString(name) || utf8.RuneCountInString(value) > maxLabelValueChars {
+			return false
+		}
+	}
+	return true
+}
+
+func validNote(note string) bool {
+	return utf8.RuneCountInString(note) <= maxNoteChars
+}
+
+// normalizeOwner returns the bare email address of the owner contact, empty clears it
+func normalizeOwner(owner string) (string, bool) {
+	owner = strings.TrimSpace(owner)
+	if owner == "" {
+		return "", true
+	}
+	addr, err := mail.ParseAddress(owner)
+	if err != nil {
+		return "", false
+	}
+	return addr.Address, true
+}
+
+// validate checks the fields of the update and normalizes the owner address. It returns the
+// error code for the response if a field is invalid.
+func (m *MetadataUpdate) validate() string {
+	if m.Labels != nil && !validLabels(*m.Labels) {
+		return "invalid_labels"
+	}
+	if m.Note != nil && !validNote(*m.Note) {
+		return "invalid_note"
+	}
+	if m.Owner != nil {
+		owner, ok := normalizeOwner(*m.Owner)
+		if !ok {
+			return "invalid_owner"
+		}
+		m.Owner = &owner
+	}
+	return ""
+}
+
+// parseLabelFilter parses a label filter in the form name=value
+func parseLabelFilter(filter string) (string, string, bool) {
+	name, value, ok := strings.Cut(filter, "=")
+	if !ok || !labelNameRegexp.MatchString(name) {
+		return "", "", false
+	}
+	return name, value, true
+}
+
+// webUpdateMetadata changes the labels, note or owner of a registration, the route is wrapped in ActorAuth
+func webUpdateMetadata(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	actor, ok := r.Context().Value(ActorKey).(Actor)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	subdomain := p.ByName("subdomain")
+	if !validSubdomain(subdomain) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("bad_subdomain"))
+		return
+	}
+	var upd MetadataUpdate
+	err := json.NewDecoder(r.Body).Decode(&upd)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("malformed_json_payload"))
+		return
+	}
+	if errCode := upd.validate(); errCode != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError(errCode))
+		return
+	}
+
+	rec, err := DB.UpdateMetadata(actor, subdomain, upd)
+	if err == errNotOwner {
+		log.WithFields(log.Fields{"error": "subdomain_mismatch", "subdomain": subdomain, "user": actor.Username.String()}).Error("Metadata update not allowed")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("forbidden"))
+		return
+	}
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "subdomain": subdomain}).Error("Error updating metadata")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+
+	log.WithFields(log.Fields{"subdomain": subdomain}).Debug("Metadata updated")
+	resp, err := json.Marshal(map[string]interface{}{"subdomain": rec.Subdomain, "labels": rec.Labels, "note": rec.Note, "owner": rec.Owner})
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
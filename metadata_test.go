@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMetadataUpdateValidate(t *testing.T) {
+	str := func(s string) *string { return &s }
+	labels := func(l map[string]string) *map[string]string { return &l }
+	for i, test := range []struct {
+		upd     MetadataUpdate
+		errCode string
+		owner   string
+	}{
+		{MetadataUpdate{}, "", ""},
+		{MetadataUpdate{Labels: labels(map[string]string{"team": "payments", "k8s.io/app": ""})}, "", ""},
+		{MetadataUpdate{Labels: labels(map[string]string{"bad name": "x"})}, "invalid_labels", ""},
+		{MetadataUpdate{Labels: labels(map[string]string{"ticket": strings.Repeat("x", 256)})}, "invalid_labels", ""},
+		{MetadataUpdate{Note: str(strings.Repeat("x", 1024))}, "", ""},
+		{MetadataUpdate{Note: str(strings.Repeat("x", 1025))}, "invalid_note", ""},
+		{MetadataUpdate{Owner: str("Ops Team <ops@example.com>")}, "", "ops@example.com"},
+		{MetadataUpdate{Owner: str(" ")}, "", ""},
+		{MetadataUpdate{Owner: str("not an address")}, "invalid_owner", ""},
+	} {
+		errCode := test.upd.validate()
+		if errCode != test.errCode {
+			t.Errorf("Test %d: Expected error code [%s], got [%s]", i, test.errCode, errCode)
+		}
+		if errCode == "" && test.upd.Owner != nil && *test.upd.Owner != test.owner {
+			t.Errorf("Test %d: Expected owner [%s], got [%s]", i, test.owner, *test.upd.Owner)
+		}
+	}
+}
+
+func TestParseLabelFilter(t *testing.T) {
+	for i, test := range []struct {
+		filter string
+		name   string
+		value  string
+		ok     bool
+	}{
+		{"team=payments", "team", "payments", true},
+		{"env=", "env", "", true},
+		{"note=a=b", "note", "a=b", true},
+		{"team", "", "", false},
+		{"=payments", "", "", false},
+	} {
+		name, value, ok := parseLabelFilter(test.filter)
+		if name != test.name || value != test.value || ok != test.ok {
+			t.Errorf("Test %d: Expected [%s] [%s] [%t], got [%s] [%s] [%t]", i, test.name, test.value, test.ok, name, value, ok)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// metricsRegistry holds the metrics served at /metrics
+var metricsRegistry = newMetricsRegistry()
+
+var metrics = promauto.With(metricsRegistry)
+
+var (
+	dnsQueries = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "acmedns_dns_queries_total",
+		Help: "DNS questions answered, by query type and response code.",
+	}, []string{"qtype", "rcode"})
+	txtLookupDuration = metrics.NewHistogram(prometheus.HistogramOpts{
+		Name:    "acmedns_dns_txt_lookup_duration_seconds",
+		Help:    "Time taken to look up the TXT values of a subdomain from the database.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	apiRequests = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "acmedns_api_requests_total",
+		Help: "HTTP API requests, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	authFailures = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "acmedns_api_auth_failures_total",
+		Help: "Failed X-Api-User and X-Api-Key authentications, by reason.",
+	}, []string{"reason"})
+	registrations = metrics.NewCounter(prometheus.CounterOpts{
+		Name: "acmedns_registrations_total",
+		Help: "Records created through the registration endpoint.",
+	})
+	dbErrors = metrics.NewCounter(prometheus.CounterOpts{
+		Name: "acmedns_db_errors_total",
+		Help: "Unexpected database errors while serving DNS and API requests.",
+	})
+	_ = metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "acmedns_records",
+		Help: "Registered records in the database.",
+	}, countRecords)
+)
+
+// Reasons of authentication failures
+const (
+	authLockedOut       = "locked_out"
+	authInvalidUsername = "invalid_username"
+	authUnknownUser     = "unknown_user"
+	authInvalidKey      = "invalid_key"
+	authInvalidPassword = "invalid_password"
+)
+
+// metricQtypes are the query types counted by name, the query type is chosen by the client and any
+// other is counted as "other" to keep the number of series bounded
+var metricQtypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeNS:    true,
+	dns.TypeSOA:   true,
+	dns.TypeTXT:   true,
+	dns.TypeCAA:   true,
+	dns.TypeANY:   true,
+}
+
+// qtypeLabel returns the qtype label of the DNS query metrics for the query type
+func qtypeLabel(qtype uint16) string {
+	if metricQtypes[qtype] {
+		return dns.TypeToString[qtype]
+	}
+	return "other"
+}
+
+func newMetricsRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+// recordCountTTL is how long the number of records is reused between scrapes
+const recordCountTTL = 30 * time.Second
+
+// recordCount caches the number of records, counting them runs a COUNT(*) under the database lock
+var recordCount struct {
+	Mutex   sync.Mutex
+	value   float64
+	expires time.Time
+}
+
+// countRecords returns the number of records for the records gauge, counted at most once per recordCountTTL
+func countRecords() float64 {
+	if DB == nil {
+		return math.NaN()
+	}
+	recordCount.Mutex.Lock()
+	defer recordCount.Mutex.Unlock()
+	if time.Now().Before(recordCount.expires) {
+		return recordCount.value
+	}
+	n, err := DB.CountDomains(DomainQuery{})
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error counting records for metrics")
+		return math.NaN()
+	}
+	recordCount.value = float64(n)
+	recordCount.expires = time.Now().Add(recordCountTTL)
+	return recordCount.value
+}
+
+// metricsHandler serves the metrics in the Prometheus exposition format
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+func webGetMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	metricsHandler.ServeHTTP(w, r)
+}
+
+// apiRouter is a httprouter.Router that counts the requests to each of its routes in the API metrics.
+// Routes are labeled with the registered path, so that parameters do not create new series.
+type apiRouter struct {
+	*httprouter.Router
+}
+
+func newAPIRouter() *apiRouter {
+	return &apiRouter{httprouter.New()}
+}
+
+// Handle registers the handle for the method and path
+func (a *apiRouter) Handle(method string, path string, handle httprouter.Handle) {
+	a.Router.Handle(method, path, countRequests(method, path, handle))
+}
+
+// GET registers the handle for GET requests to the path
+func (a *apiRouter) GET(path string, handle httprouter.Handle) {
+	a.Handle(http.MethodGet, path, handle)
+}
+
+// POST registers the handle for POST requests to the path
+func (a *apiRouter) POST(path string, handle httprouter.Handle) {
+	a.Handle(http.MethodPost, path, handle)
+}
+
+// PATCH registers the handle for PATCH requests to the path
+func (a *apiRouter) PATCH(path string, handle httprouter.Handle) {
+	a.Handle(http.MethodPatch, path, handle)
+}
+
+// DELETE registers the handle for DELETE requests to the path
+func (a *apiRouter) DELETE(path string, handle httprouter.Handle) {
+	a.Handle(http.MethodDelete, path, handle)
+}
+
+// countRequests middleware counts the requests to the route by their response status
+func countRequests(method string, route string, handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		rec := &statusRecorder{ResponseWriter: w}
+		handle(rec, r, p)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		apiRequests.WithLabelValues(method, route, strconv.Itoa(rec.status)).Inc()
+	}
+}
+
+// statusRecorder remembers the status code written to the wrapped ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
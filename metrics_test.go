@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAPIRequestMetrics(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+
+	created := apiRequests.WithLabelValues("POST", "/register", "201")
+	unauthorized := apiRequests.WithLabelValues("DELETE", "/domains/:subdomain", "401")
+	before := testutil.ToFloat64(created)
+	beforeUnauthorized := testutil.ToFloat64(unauthorized)
+	beforeRegistrations := testutil.ToFloat64(registrations)
+
+	e.POST("/register").Expect().Status(http.StatusCreated)
+	e.DELETE("/domains/metrics-test").Expect().Status(http.StatusUnauthorized)
+
+	if d := testutil.ToFloat64(created) - before; d != 1 {
+		t.Errorf("Expected one counted registration request, got %v", d)
+	}
+	if d := testutil.ToFloat64(unauthorized) - beforeUnauthorized; d != 1 {
+		t.Errorf("Expected one counted request labeled with the route, got %v", d)
+	}
+	if d := testutil.ToFloat64(registrations) - beforeRegistrations; d != 1 {
+		t.Errorf("Expected one counted registration, got %v", d)
+	}
+}
+
+func TestAuthFailureMetrics(t *testing.T) {
+	for i, test := range []struct {
+		user   string
+		key    string
+		reason string
+	}{
+		{"not-a-uuid", "", authInvalidUsername},
+		{"c36f50e8-4632-44f0-83fe-e070fef28a10", "short", authInvalidKey},
+		{"c36f50e8-4632-44f0-83fe-e070fef28a10", "LHc8TqSsJXbPRSCl5bQwdBPkdfKFatxtxTUBydBs", authUnknownUser},
+	} {
+		r := http.Request{RemoteAddr: "192.0.2.21:1234", Header: http.Header{}}
+		r.Header.Set("X-Api-User", test.user)
+		r.Header.Set("X-Api-Key", test.key)
+		before := testutil.ToFloat64(authFailures.WithLabelValues(test.reason))
+		if _, _, err := getUserFromRequest(&r); err == nil {
+			t.Errorf("Test %d: Expected authentication to fail", i)
+		}
+		if d := testutil.ToFloat64(authFailures.WithLabelValues(test.reason)) - before; d != 1 {
+			t.Errorf("Test %d: Expected one failure with reason %s, got %v", i, test.reason, d)
+		}
+	}
+}
+
+func TestDNSQueryMetrics(t *testing.T) {
+	nxdomain := dnsQueries.WithLabelValues("TXT", "NXDOMAIN")
+	before := testutil.ToFloat64(nxdomain)
+	q := dns.Question{Name: dns.Fqdn("metrics.nonexistent.tld"), Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	if _, _, _, err := dnsserver.answer(q); err != nil {
+		t.Fatalf("Unexpected error [%v]", err)
+	}
+	if d := testutil.ToFloat64(nxdomain) - before; d != 1 {
+		t.Errorf("Expected one counted NXDOMAIN answer, got %v", d)
+	}
+}
+
+func TestQtypeLabel(t *testing.T) {
+	for i, test := range []struct {
+		qtype    uint16
+		expected string
+	}{
+		{dns.TypeTXT, "TXT"},
+		{dns.TypeCAA, "CAA"},
+		{dns.TypeANY, "ANY"},
+		{dns.TypeMX, "other"},
+		{65280, "other"},
+	} {
+		if ret := qtypeLabel(test.qtype); ret != test.expected {
+			t.Errorf("Test %d: Expected [%s], got [%s]", i, test.expected, ret)
+		}
+	}
+}
+
+func TestCountRecordsCached(t *testing.T) {
+	recordCount.expires = time.Time{}
+	first := countRecords()
+	registerTestUser(t)
+	if n := countRecords(); n != first {
+		t.Errorf("Expected the cached number of records %v, got %v", first, n)
+	}
+	recordCount.expires = time.Time{}
+	if n := countRecords(); n != first+1 {
+		t.Errorf("Expected %v records after the cache expired, got %v", first+1, n)
+	}
+}
+
+func TestMetricsEndpointAuth(t *testing.T) {
+	router := setupRouter(false, false)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	e := getExpect(t, server)
+	withAdminToken(t)
+
+	e.GET("/metrics").Expect().Status(http.StatusUnauthorized)
+	e.GET("/metrics").
+		WithHeader("Authorization", "Bearer secret-admin-token").
+		Expect().
+		Status(http.StatusOK)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	registerTestUser(t)
+	w := httptest.NewRecorder()
+	webGetMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	for _, name := range []string{"acmedns_records ", "acmedns_dns_txt_lookup_duration_seconds_bucket", "go_goroutines"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("Expected metric %s in the output", name)
+		}
+	}
+	if strings.Contains(body, "acmedns_records NaN") {
+		t.Errorf("Expected the number of records, got NaN")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	log "github.com/sirupsen/logrus"
+)
+
+// proxyHeaderTimeout is how long a new connection may take to send its PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyProtocolListener wraps the listener to read the client address from PROXY protocol v1 and v2
+// headers. Headers are only accepted from the trusted proxies, other connections sending one are closed.
+func proxyProtocolListener(ln net.Listener) net.Listener {
+	return &proxyproto.Listener{
+		Listener:          ln,
+		Policy:            proxyProtocolPolicy,
+		ReadHeaderTimeout: proxyHeaderTimeout,
+	}
+}
+
+func proxyProtocolPolicy(upstream net.Addr) (proxyproto.Policy, error) {
+	host, _, err := net.SplitHostPort(upstream.String())
+	if err == nil && trustedProxy(host) {
+		return proxyproto.USE, nil
+	}
+	log.WithFields(log.Fields{"remoteaddr": upstream.String()}).Debug("Not accepting PROXY protocol header from untrusted address")
+	return proxyproto.REJECT, nil
+}
+
+// listenTCP opens a TCP listener, accepting PROXY protocol headers if enabled
+func listenTCP(network string, addr string, proxyProtocol bool) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol {
+		return proxyProtocolListener(ln), nil
+	}
+	return ln, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+)
+
+func TestProxyProtocolListener(t *testing.T) {
+	defer func() { Config.API.TrustedProxies = nil }()
+	for i, test := range []struct {
+		trusted  []string
+		version  byte
+		expected string
+	}{
+		{[]string{"127.0.0.1/32"}, 1, "192.0.2.1"},
+		{[]string{"127.0.0.1/32"}, 2, "192.0.2.1"},
+		{[]string{"127.0.0.1/32"}, 0, "127.0.0.1"},
+		{[]string{"10.0.0.0/8"}, 0, "127.0.0.1"},
+		// Headers from untrusted addresses close the connection
+		{[]string{"10.0.0.0/8"}, 1, ""},
+	} {
+		Config.API.TrustedProxies = test.trusted
+		ln, err := listenTCP("tcp", "127.0.0.1:0", true)
+		if err != nil {
+			t.Fatalf("Test %d: Could not listen: [%v]", i, err)
+		}
+		remote := make(chan string, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				remote <- ""
+				return
+			}
+			defer conn.Close()
+			// The header is read on first use of the connection
+			if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+				remote <- ""
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			remote <- host
+		}()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Test %d: Could not connect: [%v]", i, err)
+		}
+		if test.version > 0 {
+			header := &proxyproto.Header{
+				Version:           test.version,
+				Command:           proxyproto.PROXY,
+				TransportProtocol: proxyproto.TCPv4,
+				SourceAddr:        &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324},
+				DestinationAddr:   &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443},
+			}
+			if _, err := header.WriteTo(conn); err != nil {
+				t.Fatalf("Test %d: Could not write header: [%v]", i, err)
+			}
+		}
+		_, _ = io.WriteString(conn, "hello\n")
+		if ret := <-remote; ret != test.expected {
+			t.Errorf("Test %d: Expected remote address [%s], got [%s]", i, test.expected, ret)
+		}
+		conn.Close()
+		ln.Close()
+	}
+}
+
+func TestProxyProtocolClientIP(t *testing.T) {
+	Config.API.TrustedProxies = []string{"127.0.0.1/32"}
+	defer func() { Config.API.TrustedProxies = nil }()
+	ln, err := listenTCP("tcp", "127.0.0.1:0", true)
+	if err != nil {
+		t.Fatalf("Could not listen: [%v]", err)
+	}
+	defer ln.Close()
+	clientIP := make(chan string, 1)
+	go func() {
+		_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP <- getClientIP(r)
+		}))
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: [%v]", err)
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "PROXY TCP4 198.51.100.7 127.0.0.1 40000 80\r\nGET /health HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if ret := <-clientIP; ret != "198.51.100.7" {
+		t.Errorf("Expected client IP [198.51.100.7], got [%s]", ret)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimiterSweepInterval is how often buckets of idle clients are dropped
+const rateLimiterSweepInterval = time.Minute
+
+// rateLimiter is a token bucket rate limiter keyed by client IP
+type rateLimiter struct {
+	Mutex     sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for the route settings, or nil if limiting is disabled
+func newRateLimiter(settings ratelimit) *rateLimiter {
+	if settings.PerMinute <= 0 {
+		return nil
+	}
+	burst := settings.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      settings.PerMinute / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of key. If the bucket is empty, it returns false
+// and the time until the next token is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	if now.Sub(l.lastSweep) > rateLimiterSweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops the buckets that would be full by now, they behave the same as new ones
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// RateLimit middleware rejects requests of clients exceeding the limit with 429
+func RateLimit(limiter *rateLimiter, handle httprouter.Handle) httprouter.Handle {
+	if limiter == nil {
+		return handle
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		ip := getClientIP(r)
+		ok, wait := limiter.allow(ip, time.Now())
+		if !ok {
+			log.WithFields(log.Fields{"ip": ip, "path": r.URL.Path}).Info("Rate limit exceeded")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write(jsonError("rate_limited"))
+			return
+		}
+		handle(w, r, p)
+	}
+}
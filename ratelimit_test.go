@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	if newRateLimiter(ratelimit{}) != nil {
+		t.Errorf("Expected no limiter without a rate")
+	}
+	if l := newRateLimiter(ratelimit{PerMinute: 10}); l == nil || l.burst != 1 {
+		t.Errorf("Expected limiter with burst of [1]")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(ratelimit{PerMinute: 60, Burst: 2})
+	now := time.Now()
+	for i, test := range []struct {
+		key     string
+		elapsed time.Duration
+		allowed bool
+	}{
+		{"10.0.0.1", 0, true},
+		{"10.0.0.1", 0, true},
+		{"10.0.0.1", 0, false},
+		{"10.0.0.2", 0, true},
+		{"10.0.0.1", 500 * time.Millisecond, false},
+		{"10.0.0.1", time.Second, true},
+		{"10.0.0.1", time.Second, false},
+	} {
+		ok, wait := l.allow(test.key, now.Add(test.elapsed))
+		if ok != test.allowed {
+			t.Errorf("Test %d: Expected allowed [%t], got [%t]", i, test.allowed, ok)
+		}
+		if !ok && (wait <= 0 || wait > time.Second) {
+			t.Errorf("Test %d: Expected wait within a second, got [%s]", i, wait)
+		}
+	}
+
+	// Idle clients are forgotten
+	l.allow("10.0.0.3", now.Add(2*rateLimiterSweepInterval))
+	if len(l.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be swept, [%d] left", len(l.buckets))
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	Config.API.UseHeader = false
+	handler := func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.WriteHeader(http.StatusOK)
+	}
+	limited := RateLimit(newRateLimiter(ratelimit{PerMinute: 1, Burst: 1}), handler)
+	for i, expected := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		r := httptest.NewRequest("POST", "/update", nil)
+		w := httptest.NewRecorder()
+		limited(w, r, nil)
+		if w.Code != expected {
+			t.Errorf("Test %d: Expected status [%d], got [%d]", i, expected, w.Code)
+		}
+		if expected == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Test %d: Expected Retry-After [60], got [%s]", i, w.Header().Get("Retry-After"))
+		}
+	}
+}
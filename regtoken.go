@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// regTokenHeader is the request header carrying a registration token
+const regTokenHeader = "X-Registration-Token"
+
+// RegToken is an invite allowing registrations while open registration is disabled
+type RegToken struct {
+	ID            string `json:"id"`
+	Token         string `json:"token,omitempty"`
+	DomainPattern string `json:"domain_pattern"`
+	MaxUses       int    `json:"max_uses"`
+	Uses          int    `json:"uses"`
+	Expires       int64  `json:"expires"`
+	CreatedAt     int64  `json:"created_at"`
+	TenantID      string `json:"tenant_id"`
+}
+
+// RegTokenRequest represents the request to mint a registration token
+type RegTokenRequest struct {
+	DomainPattern    string `json:"domain_pattern"`
+	MaxUses          int    `json:"max_uses"`
+	ExpiresInMinutes int    `json:"expires_in_minutes"`
+	Tenant           string `json:"tenant"`
+}
+
+// hashToken returns the stored form of a registration or tenant admin token. The tokens are
+// random so a plain digest is enough and keeps them searchable.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// matchesDomain checks the domain_name of a registration against the token scope
+func (rt RegToken) matchesDomain(domainName string) bool {
+	if rt.DomainPattern == "" {
+		return true
+	}
+	match, err := path.Match(strings.ToLower(rt.DomainPattern), strings.ToLower(domainName))
+	return err == nil && match
+}
+
+// webRegTokenPost mints a new registration token, the route is wrapped in AdminAuth
+func webRegTokenPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req RegTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("malformed_json_payload"))
+		return
+	}
+	// Tokens are one-time unless told otherwise
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.MaxUses < 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_max_uses"))
+		return
+	}
+	if req.ExpiresInMinutes < 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_expires_in_minutes"))
+		return
+	}
+	if _, err := path.Match(req.DomainPattern, ""); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_domain_pattern"))
+		return
+	}
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	tenant, err := tenantForActor(actor, req.Tenant)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("forbidden"))
+		return
+	}
+	rt := RegToken{DomainPattern: req.DomainPattern, MaxUses: req.MaxUses, TenantID: tenant}
+	if req.ExpiresInMinutes > 0 {
+		rt.Expires = time.Now().Add(time.Duration(req.ExpiresInMinutes) * time.Minute).Unix()
+	}
+	rt, err = DB.NewRegToken(actor, rt)
+	if err == errNoTenant {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("unknown_tenant"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error creating registration token")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	log.WithFields(log.Fields{"id": rt.ID, "domain_pattern": rt.DomainPattern, "max_uses": rt.MaxUses}).Info("Created registration token")
+	resp, err := json.Marshal(rt)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write(resp)
+}
+
+// webGetRegTokens lists the registration tokens of the tenant of the caller, the route is wrapped in AdminAuth
+func webGetRegTokens(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	tokens, err := DB.GetRegTokens(actor)
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error fetching registration tokens")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	if tokens == nil {
+		tokens = []RegToken{}
+	}
+	resp, err := json.Marshal(tokens)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// webDeleteRegToken revokes a registration token, the route is wrapped in AdminAuth
+func webDeleteRegToken(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	err := DB.DeleteRegToken(actor, id)
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "id": id}).Error("Error deleting registration token")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	log.WithFields(log.Fields{"id": id}).Info("Deleted registration token")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("{\"id\": \"" + id + "\"}"))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	stdlog "log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/rs/cors"
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadableSettings are the configuration options applied on SIGHUP as section.option, changing
+// any other option needs a restart
+var reloadableSettings = map[string]bool{
+	"general.records":        true,
+	"general.nsname":         true,
+	"general.nsadmin":        true,
+	"general.debug":          true,
+	"api.corsorigins":        true,
+	"api.tls_cert_privkey":   true,
+	"api.tls_cert_fullchain": true,
+	"logconfig.loglevel":     true,
+	"logconfig.logformat":    true,
+}
+
+// reloadable holds the parts of the running servers that follow configuration changes
+type reloadable struct {
+	dnsservers []*DNSServer
+	// api is nil until the HTTP API is started
+	api *corsHandler
+	// certs is nil unless the API certificate is loaded from files
+	certs *certificateFiles
+}
+
+// reload reads the configuration file again and applies the changed options. Nothing is applied
+// if the new configuration is invalid or changes options that need a restart.
+func (rl *reloadable) reload(fname string) error {
+	conf, err := readConfig(fname)
+	if err != nil {
+		return err
+	}
+	var static []string
+	for _, name := range changedSettings(Config, conf) {
+		if !reloadableSettings[name] {
+			static = append(static, name)
+		}
+	}
+	if len(static) > 0 {
+		return fmt.Errorf("options can not be changed without a restart: %s", strings.Join(static, ", "))
+	}
+	if rl.certs != nil {
+		if err = rl.certs.load(conf.API.TLSCertFullchain, conf.API.TLSCertPrivkey); err != nil {
+			return fmt.Errorf("could not load API certificate: %w", err)
+		}
+	}
+	setupLogging(conf.Logconfig.Format, conf.Logconfig.Level)
+	for _, d := range rl.dnsservers {
+		d.ReloadRecords(conf)
+	}
+	if rl.api != nil {
+		rl.api.configure(conf)
+	}
+	applySettings(&Config, conf)
+	return nil
+}
+
+// settingName returns the name of a section or an option as written in the configuration file
+func settingName(f reflect.StructField) string {
+	if tag, _, _ := strings.Cut(f.Tag.Get("toml"), ","); tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// changedSettings lists the options that differ between the configurations as section.option
+func changedSettings(old DNSConfig, cur DNSConfig) []string {
+	var changed []string
+	ov, cv := reflect.ValueOf(old), reflect.ValueOf(cur)
+	for i := 0; i < ov.NumField(); i++ {
+		section := settingName(ov.Type().Field(i))
+		for j := 0; j < ov.Field(i).NumField(); j++ {
+			if !reflect.DeepEqual(ov.Field(i).Field(j).Interface(), cv.Field(i).Field(j).Interface()) {
+				changed = append(changed, section+"."+settingName(ov.Field(i).Type().Field(j)))
+			}
+		}
+	}
+	return changed
+}
+
+// applySettings copies the reloadable options from conf, leaving the options in use by running requests untouched
+func applySettings(target *DNSConfig, conf DNSConfig) {
+	tv, cv := reflect.ValueOf(target).Elem(), reflect.ValueOf(conf)
+	for i := 0; i < tv.NumField(); i++ {
+		section := settingName(tv.Type().Field(i))
+		for j := 0; j < tv.Field(i).NumField(); j++ {
+			if reloadableSettings[section+"."+settingName(tv.Field(i).Type().Field(j))] {
+				tv.Field(i).Field(j).Set(cv.Field(i).Field(j))
+			}
+		}
+	}
+}
+
+// corsHandler applies the CORS options of the configuration to the requests of the API
+type corsHandler struct {
+	Mutex  sync.RWMutex
+	next   http.Handler
+	logger *stdlog.Logger
+	cors   *cors.Cors
+}
+
+// newCORSHandler wraps the handler, debug messages are written to logger
+func newCORSHandler(next http.Handler, logger *stdlog.Logger, config DNSConfig) *corsHandler {
+	h := &corsHandler{next: next, logger: logger}
+	h.configure(config)
+	return h
+}
+
+// configure replaces the CORS options with the ones in config
+func (h *corsHandler) configure(config DNSConfig) {
+	c := cors.New(cors.Options{
+		AllowedOrigins:     config.API.CorsOrigins,
+		AllowedMethods:     []string{"GET", "POST", "DELETE", "PATCH"},
+		ExposedHeaders:     []string{"X-Total-Count", "X-Next-Cursor"},
+		OptionsPassthrough: false,
+		Debug:              config.General.Debug,
+	})
+	if config.General.Debug {
+		// Logwriter for saner log output
+		c.Log = h.logger
+	}
+	h.Mutex.Lock()
+	defer h.Mutex.Unlock()
+	h.cors = c
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Mutex.RLock()
+	c := h.cors
+	h.Mutex.RUnlock()
+	c.ServeHTTP(w, r, h.next.ServeHTTP)
+}
+
+// certificateFiles is the API certificate loaded from the configured files
+type certificateFiles struct {
+	Mutex sync.RWMutex
+	cert  *tls.Certificate
+	check func() error
+}
+
+// load reads the certificate and the private key, replacing the ones in use if they are valid
+func (c *certificateFiles) load(fullchain string, privkey string) error {
+	cert, err := tls.LoadX509KeyPair(fullchain, privkey)
+	if err != nil {
+		return err
+	}
+	check, err := keyPairCheck(cert)
+	if err != nil {
+		return err
+	}
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.cert = &cert
+	c.check = check
+	log.WithFields(log.Fields{"fullchain": fullchain}).Info("Loaded API certificate")
+	return nil
+}
+
+// GetCertificate returns the certificate for the TLS handshake
+func (c *certificateFiles) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	return c.cert, nil
+}
+
+// Check is the readiness check of the certificate in use
+func (c *certificateFiles) Check() error {
+	c.Mutex.RLock()
+	defer c.Mutex.RUnlock()
+	return c.check()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const reloadTestConfig = `[general]
+listen = "127.0.0.1:15353"
+protocol = "udp"
+domain = "auth.example.org"
+nsname = "ns1.auth.example.org"
+nsadmin = "admin.example.org"
+records = [%s]
+
+[database]
+engine = "sqlite3"
+connection = ":memory:"
+
+[api]
+corsorigins = [%s]
+
+[logconfig]
+loglevel = "%s"
+`
+
+func writeReloadConfig(t *testing.T, fname string, records string, origins string, level string) {
+	conf := fmt.Sprintf(reloadTestConfig, records, origins, level)
+	if err := os.WriteFile(fname, []byte(conf), 0600); err != nil {
+		t.Fatalf("Could not write config file [%v]", err)
+	}
+}
+
+func TestChangedSettings(t *testing.T) {
+	old := DNSConfig{General: general{Listen: ":53"}, API: httpapi{CorsOrigins: []string{"*"}}}
+	cur := old
+	cur.General.Listen = "127.0.0.1:53"
+	cur.API.CorsOrigins = []string{"https://example.org"}
+	cur.RateLimit.Register.Burst = 5
+	expected := []string{"general.listen", "api.corsorigins", "ratelimit.register"}
+	if changed := changedSettings(old, cur); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Expected %v, got %v", expected, changed)
+	}
+	if changed := changedSettings(old, old); len(changed) != 0 {
+		t.Errorf("Expected no changes, got %v", changed)
+	}
+}
+
+func TestReload(t *testing.T) {
+	oldConfig := Config
+	oldLevel := log.GetLevel()
+	defer func() {
+		Config = oldConfig
+		log.SetLevel(oldLevel)
+	}()
+	fname := filepath.Join(t.TempDir(), "config.cfg")
+	writeReloadConfig(t, fname, `"auth.example.org. A 192.0.2.1"`, `"*"`, "info")
+	var err error
+	Config, err = readConfig(fname)
+	if err != nil {
+		t.Fatalf("Could not read config [%v]", err)
+	}
+	d := NewDNSServer(DB, Config.General.Listen, Config.General.Proto, Config.General.Domain)
+	d.ParseRecords(Config)
+	rl := &reloadable{dnsservers: []*DNSServer{d}}
+
+	writeReloadConfig(t, fname, `"auth.example.org. A 192.0.2.2", "www.auth.example.org. CNAME auth.example.org."`, `"https://example.org"`, "debug")
+	if err = rl.reload(fname); err != nil {
+		t.Fatalf("Unexpected error [%v]", err)
+	}
+	rr, _ := d.getRecord(dns.Question{Name: "auth.example.org.", Qtype: dns.TypeA})
+	if len(rr) != 1 || rr[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("Expected the reloaded A record, got %v", rr)
+	}
+	if !d.answeringForDomain("www.auth.example.org.") {
+		t.Errorf("Expected the added record to be served")
+	}
+	if d.SOA == nil {
+		t.Errorf("Expected SOA to be set")
+	}
+	if log.GetLevel() != log.DebugLevel {
+		t.Errorf("Expected log level debug, got %s", log.GetLevel())
+	}
+	if !reflect.DeepEqual(Config.API.CorsOrigins, []string{"https://example.org"}) {
+		t.Errorf("Expected the CORS origins to be updated, got %v", Config.API.CorsOrigins)
+	}
+
+	// Nothing is applied when an option needing a restart changed
+	writeReloadConfig(t, fname, `"auth.example.org. A 192.0.2.3"`, `"*"`, "info")
+	conf, _ := os.ReadFile(fname)
+	_ = os.WriteFile(fname, []byte(strings.Replace(string(conf), "127.0.0.1:15353", "127.0.0.1:15354", 1)), 0600)
+	err = rl.reload(fname)
+	if err == nil || !strings.Contains(err.Error(), "general.listen") {
+		t.Errorf("Expected error about general.listen, got [%v]", err)
+	}
+	rr, _ = d.getRecord(dns.Question{Name: "auth.example.org.", Qtype: dns.TypeA})
+	if len(rr) != 1 || rr[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Errorf("Expected records to be kept, got %v", rr)
+	}
+	if log.GetLevel() != log.DebugLevel || Config.General.Listen != "127.0.0.1:15353" {
+		t.Errorf("Expected configuration to be kept")
+	}
+
+	// Invalid configuration is rejected
+	_ = os.WriteFile(fname, []byte("[general"), 0600)
+	if err = rl.reload(fname); err == nil {
+		t.Errorf("Expected error for invalid configuration file")
+	}
+}
+
+func TestCORSHandlerConfigure(t *testing.T) {
+	h := newCORSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), nil, DNSConfig{API: httpapi{CorsOrigins: []string{"https://a.example.org"}}})
+	allowed := func(origin string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/health", nil)
+		r.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Header().Get("Access-Control-Allow-Origin") == origin
+	}
+	if !allowed("https://a.example.org") || allowed("https://b.example.org") {
+		t.Errorf("Expected only the configured origin to be allowed")
+	}
+	h.configure(DNSConfig{API: httpapi{CorsOrigins: []string{"https://b.example.org"}}})
+	if allowed("https://a.example.org") || !allowed("https://b.example.org") {
+		t.Errorf("Expected only the reconfigured origin to be allowed")
+	}
+}
+
+func writeKeyPair(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key [%v]", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate [%v]", err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestCertificateFilesLoad(t *testing.T) {
+	dir := t.TempDir()
+	certs := &certificateFiles{}
+	first, firstKey := writeKeyPair(t, dir, "first")
+	second, secondKey := writeKeyPair(t, dir, "second")
+	commonName := func() string {
+		cert, _ := certs.GetCertificate(nil)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+
+	if err := certs.load(first, firstKey); err != nil {
+		t.Fatalf("Unexpected error [%v]", err)
+	}
+	if err := certs.Check(); err != nil || commonName() != "first" {
+		t.Errorf("Expected the first certificate, got %s [%v]", commonName(), err)
+	}
+	if err := certs.load(second, secondKey); err != nil {
+		t.Fatalf("Unexpected error [%v]", err)
+	}
+	if commonName() != "second" {
+		t.Errorf("Expected the reloaded certificate, got %s", commonName())
+	}
+	// A failing reload keeps the certificate in use
+	if err := certs.load(first, secondKey); err == nil {
+		t.Errorf("Expected error for mismatching key")
+	}
+	if commonName() != "second" {
+		t.Errorf("Expected the certificate to be kept, got %s", commonName())
+	}
+}
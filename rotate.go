@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRotationGrace is the longest time a rotated password can stay valid
+const maxRotationGrace = 24 * time.Hour
+
+// RotateRequest represents the request to rotate the password of a registration
+type RotateRequest struct {
+	Subdomain    string `json:"subdomain"`
+	GraceMinutes int    `json:"grace_minutes"`
+}
+
+// webRotatePost issues a new password for a registration, the route is wrapped in ActorAuth
+func webRotatePost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	actor, ok := r.Context().Value(ActorKey).(Actor)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
+	var req RotateRequest
+	// The request body is optional
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_request"))
+		return
+	}
+	// Record owners rotate their own password by default
+	if req.Subdomain == "" {
+		req.Subdomain = actor.Subdomain
+	}
+	if !validSubdomain(req.Subdomain) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("bad_subdomain"))
+		return
+	}
+	grace := time.Duration(req.GraceMinutes) * time.Minute
+	if grace < 0 || grace > maxRotationGrace {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_grace_minutes"))
+		return
+	}
+
+	rec, err := DB.RotatePassword(actor, req.Subdomain, grace)
+	credCache.invalidate(req.Subdomain)
+	if err == errNotOwner {
+		log.WithFields(log.Fields{"error": "subdomain_mismatch", "subdomain": req.Subdomain, "user": actor.Username.String()}).Error("Password rotation not allowed")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("forbidden"))
+		return
+	}
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "subdomain": req.Subdomain}).Error("Error rotating password")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+
+	log.WithFields(log.Fields{"user": rec.Username.String(), "grace": grace.String()}).Debug("Password rotated")
+	resp, err := json.Marshal(RegResponse{rec.Username.String(), rec.Password, rec.Subdomain + "." + Config.General.Domain, rec.Subdomain, rec.AllowFrom.ValidEntries()})
+	if err != nil {
+		log.WithFields(log.Fields{"error": "json"}).Debug("Could not marshal JSON")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
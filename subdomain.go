@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// errSubdomainTaken is returned when the requested subdomain is already registered
+var errSubdomainTaken = errors.New("subdomain already registered")
+
+// subdomainRetries is how many random suffixes are tried for a derived subdomain
+const subdomainRetries = 5
+
+// slugInvalidChars matches everything not allowed in a subdomain label
+var slugInvalidChars = regexp.MustCompile("[^a-z0-9]+")
+
+// reservedSubdomain checks the subdomain against the configured reserved names and the names of the
+// static records, which would be shadowed by a registration
+func reservedSubdomain(subdomain string) bool {
+	for _, r := range Config.API.ReservedSubdomains {
+		if strings.EqualFold(r, subdomain) {
+			return true
+		}
+	}
+	if subdomain == "" {
+		return false
+	}
+	name := strings.TrimSuffix(subdomain+"."+Config.General.Domain, ".")
+	for _, r := range Config.General.StaticRecords {
+		if fields := strings.Fields(r); len(fields) > 0 && strings.EqualFold(strings.TrimSuffix(fields[0], "."), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveSubdomain builds a readable subdomain from a domain name with a random suffix,
+// eg. example-com-3f2a for example.com. An empty string is returned if nothing usable is left.
+func deriveSubdomain(domainName string) string {
+	slug := slugInvalidChars.ReplaceAllString(strings.ToLower(domainName), "-")
+	slug = strings.Trim(slug, "-")
+	if slug == "" {
+		return ""
+	}
+	// Leave room for the suffix within the 63 character label limit
+	if len(slug) > 58 {
+		slug = strings.TrimRight(slug[:58], "-")
+	}
+	suffix := make([]byte, 2)
+	_, _ = rand.Read(suffix)
+	return slug + "-" + hex.EncodeToString(suffix)
+}
+
+// isUniqueViolation checks if the database refused an insert because of a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeriveSubdomain(t *testing.T) {
+	for i, test := range []struct {
+		domainName string
+		prefix     string
+	}{
+		{"example.com", "example-com-"},
+		{"*.Example.COM", "example-com-"},
+		{"sub--domain..example.org.", "sub-domain-example-org-"},
+		{strings.Repeat("a", 70) + ".com", strings.Repeat("a", 58) + "-"},
+		{"", ""},
+		{"*.", ""},
+	} {
+		ret := deriveSubdomain(test.domainName)
+		if test.prefix == "" {
+			if ret != "" {
+				t.Errorf("Test %d: Expected empty subdomain, got [%s]", i, ret)
+			}
+			continue
+		}
+		if !strings.HasPrefix(ret, test.prefix) || len(ret) != len(test.prefix)+4 {
+			t.Errorf("Test %d: Expected subdomain [%sxxxx], got [%s]", i, test.prefix, ret)
+		}
+		if !validSubdomain(ret) {
+			t.Errorf("Test %d: Derived subdomain [%s] is not valid", i, ret)
+		}
+	}
+}
+
+func TestReservedSubdomain(t *testing.T) {
+	Config.API.ReservedSubdomains = []string{"www", "ns1"}
+	Config.General.Domain = "auth.example.org"
+	Config.General.StaticRecords = []string{"auth.example.org. A 192.0.2.1", "ns3.auth.example.org. A 192.0.2.3", "Mail.Auth.Example.org. MX 10 mx.example.org."}
+	defer func() {
+		Config.API.ReservedSubdomains = nil
+		Config.General.Domain = ""
+		Config.General.StaticRecords = nil
+	}()
+	for i, test := range []struct {
+		subdomain string
+		output    bool
+	}{
+		{"www", true},
+		{"NS1", true},
+		{"ns2", false},
+		{"ns3", true},
+		{"mail", true},
+		{"auth", false},
+		{"", false},
+	} {
+		if ret := reservedSubdomain(test.subdomain); ret != test.output {
+			t.Errorf("Test %d: Expected [%t] for [%s], got [%t]", i, test.output, test.subdomain, ret)
+		}
+	}
+}
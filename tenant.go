@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
+)
+
+// Tenant is a group of records managed by its own administrators
+type Tenant struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Token     string `json:"token,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// TenantRequest represents the request to create a tenant
+type TenantRequest struct {
+	Name string `json:"name"`
+}
+
+var tenantNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+func validTenantName(name string) bool {
+	return tenantNameRegexp.MatchString(name)
+}
+
+// tenantForActor returns the tenant of records and registration tokens created by the actor. Tenant
+// administrators create them in their own tenant, superadministrators in the requested one.
+func tenantForActor(actor Actor, requested string) (string, error) {
+	if actor.isSuperadmin() {
+		return requested, nil
+	}
+	if requested != "" && requested != actor.Tenant {
+		return "", errNotOwner
+	}
+	return actor.Tenant, nil
+}
+
+// webTenantPost creates a tenant and returns its admin token, the route is wrapped in SuperadminAuth
+func webTenantPost(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req TenantRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("malformed_json_payload"))
+		return
+	}
+	if !validTenantName(req.Name) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write(jsonError("invalid_name"))
+		return
+	}
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	t, err := DB.NewTenant(actor, req.Name)
+	if isUniqueViolation(err) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(jsonError("tenant_exists"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error creating tenant")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	log.WithFields(log.Fields{"id": t.ID, "name": t.Name, "admin": actor.Admin}).Info("Created tenant")
+	writeTenant(w, http.StatusCreated, t)
+}
+
+// webGetTenants lists the tenants, the route is wrapped in SuperadminAuth
+func webGetTenants(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tenants, err := DB.GetTenants()
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Error fetching tenants")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	if tenants == nil {
+		tenants = []Tenant{}
+	}
+	resp, err := json.Marshal(tenants)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+// webTenantTokenPost replaces the admin token of a tenant, the route is wrapped in SuperadminAuth
+func webTenantTokenPost(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	t, err := DB.RotateTenantToken(actor, p.ByName("id"))
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "id": p.ByName("id")}).Error("Error rotating tenant token")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	log.WithFields(log.Fields{"id": t.ID, "name": t.Name, "admin": actor.Admin}).Info("Rotated tenant admin token")
+	writeTenant(w, http.StatusOK, t)
+}
+
+// webDeleteTenant removes a tenant without records, the route is wrapped in SuperadminAuth
+func webDeleteTenant(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id := p.ByName("id")
+	actor, _ := r.Context().Value(ActorKey).(Actor)
+	err := DB.DeleteTenant(actor, id)
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
+	if err == errTenantInUse {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write(jsonError("tenant_in_use"))
+		return
+	}
+	if err != nil {
+		dbErrors.Inc()
+		log.WithFields(log.Fields{"error": err.Error(), "id": id}).Error("Error deleting tenant")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("db_error"))
+		return
+	}
+	log.WithFields(log.Fields{"id": id, "admin": actor.Admin}).Info("Deleted tenant")
+	w.Header().Set("Content-Type", "application/json")
+	resp, _ := json.Marshal(map[string]string{"id": id})
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(resp)
+}
+
+func writeTenant(w http.ResponseWriter, status int, t Tenant) {
+	resp, err := json.Marshal(t)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(jsonError("json_error"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(resp)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -15,10 +16,16 @@ var DB database
 
 // DNSConfig holds the config structure
 type DNSConfig struct {
-	General   general
-	Database  dbsettings
-	API       httpapi
-	Logconfig logconfig
+	General         general
+	Database        dbsettings
+	API             httpapi
+	Admin           adminconfig
+	RateLimit       ratelimitconfig       `toml:"ratelimit"`
+	Lockout         lockoutconfig         `toml:"lockout"`
+	Hashing         hashconfig            `toml:"hashing"`
+	CredentialCache credentialcacheconfig `toml:"credential_cache"`
+	Metrics         metricsconfig         `toml:"metrics"`
+	Logconfig       logconfig
 }
 
 // Config file general section
@@ -30,6 +37,8 @@ type general struct {
 	Nsadmin       string
 	Debug         bool
 	StaticRecords []string `toml:"records"`
+	TXTTTLMinutes int      `toml:"txt_ttl_minutes"`
+	ProxyProtocol bool     `toml:"proxy_protocol"`
 }
 
 type dbsettings struct {
@@ -50,8 +59,66 @@ type httpapi struct {
 	ACMECacheDir        string `toml:"acme_cache_dir"`
 	NotificationEmail   string `toml:"notification_email"`
 	CorsOrigins         []string
-	UseHeader           bool   `toml:"use_header"`
-	HeaderName          string `toml:"header_name"`
+	UseHeader           bool     `toml:"use_header"`
+	HeaderName          string   `toml:"header_name"`
+	TrustedProxies      []string `toml:"trusted_proxies"`
+	ProxyProtocol       bool     `toml:"proxy_protocol"`
+	TXTSlots            int      `toml:"txt_slots"`
+	MaxTXTSlots         int      `toml:"max_txt_slots"`
+	ReservedSubdomains  []string `toml:"reserved_subdomains"`
+	DeriveSubdomain     bool     `toml:"derive_subdomain"`
+}
+
+// Rate limits of the API routes, per client IP
+type ratelimitconfig struct {
+	Register ratelimit `toml:"register"`
+	Update   ratelimit `toml:"update"`
+}
+
+// ratelimit is a token bucket refilled with PerMinute tokens holding up to Burst tokens
+type ratelimit struct {
+	PerMinute float64 `toml:"per_minute"`
+	Burst     int     `toml:"burst"`
+}
+
+// Lockout of usernames and client IPs after failed authentication attempts
+type lockoutconfig struct {
+	Threshold   int `toml:"threshold"`
+	BaseSeconds int `toml:"base_seconds"`
+	MaxMinutes  int `toml:"max_minutes"`
+}
+
+// Password hashing, Algorithm is either "bcrypt" or "argon2id"
+type hashconfig struct {
+	Algorithm     string `toml:"algorithm"`
+	BcryptCost    int    `toml:"bcrypt_cost"`
+	Argon2Time    uint32 `toml:"argon2_time"`
+	Argon2Memory  uint32 `toml:"argon2_memory"`
+	Argon2Threads uint8  `toml:"argon2_threads"`
+}
+
+// Cache of verified API keys, TTLSeconds = 0 disables it
+type credentialcacheconfig struct {
+	TTLSeconds int `toml:"ttl_seconds"`
+	Size       int `toml:"size"`
+}
+
+// Prometheus metrics, served on the API listener unless Listen is set
+type metricsconfig struct {
+	Enabled bool   `toml:"enabled"`
+	Listen  string `toml:"listen"`
+}
+
+// Admin API credentials
+type adminconfig struct {
+	Tokens []string    `toml:"tokens"`
+	Users  []adminuser `toml:"users"`
+}
+
+// adminuser is an administrator authenticating with HTTP basic auth, Password holds a bcrypt or argon2id hash
+type adminuser struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
 }
 
 // Logging config
@@ -62,21 +129,73 @@ type logconfig struct {
 	Format  string `toml:"logformat"`
 }
 
+// registration holds the client supplied options for a new record
+type registration struct {
+	AllowFrom  cidrslice
+	DomainName string
+	TXTSlots   int
+	RegToken   string
+	Subdomain  string
+	TenantID   string
+	Labels     map[string]string
+	Note       string
+	Owner      string
+	Actor      Actor
+}
+
+// Actor is the authenticated caller of a request, either the owner of a record or an administrator.
+// Tenant is the tenant of the record or of the tenant administrator, superadministrators have none.
+type Actor struct {
+	Username  uuid.UUID
+	Subdomain string
+	Admin     string
+	Tenant    string
+	IP        string
+}
+
+func (a Actor) isAdmin() bool {
+	return a.Admin != ""
+}
+
+// isSuperadmin checks if the actor is an administrator from the configuration file, allowed to manage all tenants
+func (a Actor) isSuperadmin() bool {
+	return a.isAdmin() && a.Tenant == ""
+}
+
 type acmedb struct {
 	Mutex sync.Mutex
-	DB *sql.DB
+	DB    *sql.DB
 }
 
 type database interface {
 	Init(string, string) error
 	Register(cidrslice) (ACMETxt, error)
-	RegisterWithName(cidrslice, string) (ACMETxt, error)
+	RegisterRecord(registration) (ACMETxt, error)
 	GetByUsername(uuid.UUID) (ACMETxt, error)
 	GetTXTForDomain(string) ([]string, error)
-	Update(ACMETxtPost) error
+	Update(Actor, ACMETxtPost) error
+	ClearTXT(Actor, ACMETxtPost) error
+	ExpireTXT(int64) ([]ACMETxtPost, error)
 	GetBackend() *sql.DB
 	SetBackend(*sql.DB)
 	Close()
-	GetAllDomains() ([]ACMETxt, error)
-	UpdateDomainName(string, string) error
+	GetDomains(DomainQuery) ([]ACMETxt, error)
+	CountDomains(DomainQuery) (int, error)
+	UpdateDomainName(Actor, string, string) error
+	DeleteRecord(Actor, string) error
+	UpdateAllowFrom(Actor, string, cidrslice) error
+	SetTXTSlots(Actor, string, int) error
+	RotatePassword(Actor, string, time.Duration) (ACMETxt, error)
+	GetRotatedPasswords(uuid.UUID) ([]string, error)
+	UpdatePasswordHash(uuid.UUID, string, string) error
+	NewRegToken(Actor, RegToken) (RegToken, error)
+	GetRegTokens(Actor) ([]RegToken, error)
+	DeleteRegToken(Actor, string) error
+	GetAuditLog(AuditQuery) ([]AuditEntry, error)
+	NewTenant(Actor, string) (Tenant, error)
+	GetTenants() ([]Tenant, error)
+	GetTenantByToken(string) (Tenant, error)
+	RotateTenantToken(Actor, string) (Tenant, error)
+	DeleteTenant(Actor, string) error
+	UpdateMetadata(Actor, string, MetadataUpdate) (ACMETxt, error)
 }
@@ -1,7 +1,7 @@
 import { Injectable } from '@angular/core';
-import { HttpClient, HttpHeaders } from '@angular/common/http';
+import { HttpClient, HttpHeaders, HttpParams } from '@angular/common/http';
 import { Observable, of } from 'rxjs';
-import { catchError, map } from 'rxjs/operators';
+import { catchError, map, switchMap } from 'rxjs/operators';
 import { AcmeDomain } from '../models/domain.model';
 import { environment } from '../environments/environment';
 
@@ -12,6 +12,7 @@ export class AcmeDnsService {
   private apiUrl = environment.apiUrl;
   private domains: Map<string, AcmeDomain> = new Map();
   private apiKey = 'acme-dns-ui-key'; // You can make this configurable
+  private pageSize = 1000; // Largest page the server returns
   
   private getApiUrl(endpoint: string): string {
     // If apiUrl is empty, use same origin
@@ -51,12 +52,27 @@ export class AcmeDnsService {
     localStorage.setItem('acme_domains', JSON.stringify(domainsArray));
   }
 
+  // Fetch every page of /domains by following X-Next-Cursor, the list is only complete after the last page
+  private fetchDomainPages(headers: HttpHeaders, cursor?: string, collected: any[] = []): Observable<any[]> {
+    let params = new HttpParams().set('limit', String(this.pageSize));
+    if (cursor) {
+      params = params.set('cursor', cursor);
+    }
+    return this.http.get<any[]>(this.getApiUrl('/domains'), { headers, params, observe: 'response' }).pipe(
+      switchMap(response => {
+        const items = collected.concat(response.body || []);
+        const next = response.headers.get('X-Next-Cursor');
+        return next ? this.fetchDomainPages(headers, next, items) : of(items);
+      })
+    );
+  }
+
   fetchDomainsFromServer(): Observable<AcmeDomain[]> {
     const headers = new HttpHeaders({
-      'X-Api-Key': this.apiKey
+      'Authorization': `Bearer ${this.apiKey}`
     });
 
-    return this.http.get<any[]>(this.getApiUrl('/domains'), { headers }).pipe(
+    return this.fetchDomainPages(headers).pipe(
       map(response => {
         // Clear existing domains
         this.domains.clear();
@@ -212,11 +228,15 @@ export class AcmeDnsService {
   }
 
   updateDomainName(fulldomain: string, newName: string): Observable<boolean> {
+    const headers = new HttpHeaders({
+      'Authorization': `Bearer ${this.apiKey}`
+    });
+
     // Update on backend
     return this.http.post(this.getApiUrl('/updatename'), {
       fulldomain: fulldomain,
       domain_name: newName
-    }).pipe(
+    }, { headers }).pipe(
       map(response => {
         // Update locally if successful
         const domain = this.domains.get(fulldomain);
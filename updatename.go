@@ -14,8 +14,12 @@ type UpdateNameRequest struct {
 	DomainName string `json:"domain_name"`
 }
 
-// webUpdateName handles domain name update requests
+// webUpdateName handles domain name update requests, the route is wrapped in ActorAuth
 func webUpdateName(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	actor, ok := r.Context().Value(ActorKey).(Actor)
+	if !ok {
+		log.WithFields(log.Fields{"error": "context"}).Error("Context error")
+	}
 	var req UpdateNameRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
@@ -47,8 +51,22 @@ func webUpdateName(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 	}
 
 	// Update the domain name in database
-	err = DB.UpdateDomainName(subdomain, req.DomainName)
+	err = DB.UpdateDomainName(actor, subdomain, req.DomainName)
+	if err == errNotOwner {
+		log.WithFields(log.Fields{"error": "subdomain_mismatch", "subdomain": subdomain, "user": actor.Username.String()}).Error("Domain name update not allowed")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write(jsonError("forbidden"))
+		return
+	}
+	if err == errNoRecord {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write(jsonError("not_found"))
+		return
+	}
 	if err != nil {
+		dbErrors.Inc()
 		log.WithFields(log.Fields{
 			"error":     err.Error(),
 			"subdomain": subdomain,
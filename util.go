@@ -5,12 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"regexp"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func jsonError(message string) []byte {
@@ -30,11 +32,18 @@ func fileIsAccessible(fname string) bool {
 	return true
 }
 
+// readConfig reads the configuration file and the overrides from the environment, without a file
+// name the configuration is read from the environment only
 func readConfig(fname string) (DNSConfig, error) {
 	var conf DNSConfig
-	_, err := toml.DecodeFile(fname, &conf)
-	if err != nil {
-		// Return with config file parsing errors from toml package
+	if fname != "" {
+		_, err := toml.DecodeFile(fname, &conf)
+		if err != nil {
+			// Return with config file parsing errors from toml package
+			return conf, err
+		}
+	}
+	if err := applyEnvOverrides(&conf); err != nil {
 		return conf, err
 	}
 	return prepareConfig(conf)
@@ -49,10 +58,50 @@ func prepareConfig(conf DNSConfig) (DNSConfig, error) {
 		return conf, errors.New("missing database configuration option \"connection\"")
 	}
 
+	for _, u := range conf.Admin.Users {
+		if !validPasswordHash(u.Password) {
+			return conf, fmt.Errorf("invalid password hash for admin user \"%s\"", u.Username)
+		}
+	}
+
+	for _, v := range conf.API.TrustedProxies {
+		if _, _, err := net.ParseCIDR(sanitizeIPv6addr(v)); err != nil {
+			return conf, fmt.Errorf("invalid CIDR in trusted_proxies: \"%s\"", v)
+		}
+	}
+
+	if conf.Hashing.Algorithm != "" && conf.Hashing.Algorithm != "bcrypt" && conf.Hashing.Algorithm != "argon2id" {
+		return conf, fmt.Errorf("invalid hashing algorithm \"%s\", expected \"bcrypt\" or \"argon2id\"", conf.Hashing.Algorithm)
+	}
+	if conf.Hashing.BcryptCost > bcrypt.MaxCost {
+		return conf, fmt.Errorf("bcrypt_cost can not be larger than %d", bcrypt.MaxCost)
+	}
+
 	// Default values for options added to config to keep backwards compatibility with old config
 	if conf.API.ACMECacheDir == "" {
 		conf.API.ACMECacheDir = "api-certs"
 	}
+	if conf.API.TXTSlots < 1 {
+		conf.API.TXTSlots = defaultTXTSlots
+	}
+	if conf.API.MaxTXTSlots < conf.API.TXTSlots {
+		conf.API.MaxTXTSlots = conf.API.TXTSlots
+	}
+	// Reverse proxy running on the same host
+	if (conf.API.UseHeader || conf.API.ProxyProtocol || conf.General.ProxyProtocol) && len(conf.API.TrustedProxies) == 0 {
+		conf.API.TrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+		log.WithFields(log.Fields{"trusted_proxies": conf.API.TrustedProxies}).Warning("No trusted_proxies configured, only trusting proxies on localhost")
+	}
+	conf.Hashing = conf.Hashing.withDefaults()
+	if conf.CredentialCache.TTLSeconds > 0 && conf.CredentialCache.Size < 1 {
+		conf.CredentialCache.Size = 10000
+	}
+	if conf.Lockout.Threshold > 0 && conf.Lockout.BaseSeconds < 1 {
+		conf.Lockout.BaseSeconds = 30
+	}
+	if conf.Lockout.Threshold > 0 && conf.Lockout.MaxMinutes < 1 {
+		conf.Lockout.MaxMinutes = 60
+	}
 
 	return conf, nil
 }
@@ -93,6 +142,8 @@ func sanitizeDomainQuestion(d string) string {
 func setupLogging(format string, level string) {
 	if format == "json" {
 		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
 	}
 	switch level {
 	default:
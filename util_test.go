@@ -135,6 +135,13 @@ func TestPrepareConfig(t *testing.T) {
 		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}}, false},
 		{DNSConfig{Database: dbsettings{Engine: "", Connection: "whatever_too"}}, true},
 		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: ""}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Admin: adminconfig{Users: []adminuser{{Username: "admin", Password: "$2a$10$8JEFVNYYhLoBysjAxe2yBuXrkDojBQBkVpXEQgyQyjn43SvJ4vL36"}}}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Admin: adminconfig{Users: []adminuser{{Username: "admin", Password: "plaintext"}}}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Admin: adminconfig{Users: []adminuser{{Username: "admin", Password: "$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$ZXhhbXBsZWtleWV4YW1wbGVrZXlleGFtcGxla2V5"}}}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Hashing: hashconfig{Algorithm: "argon2id"}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, Hashing: hashconfig{Algorithm: "md5"}}, true},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, API: httpapi{TrustedProxies: []string{"10.0.0.0/8", "[::1]/128"}}}, false},
+		{DNSConfig{Database: dbsettings{Engine: "whatever", Connection: "whatever_too"}, API: httpapi{TrustedProxies: []string{"10.0.0.1"}}}, true},
 	} {
 		_, err := prepareConfig(test.input)
 		if test.shoulderror {
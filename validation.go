@@ -3,6 +3,7 @@ package main
 import (
 	"unicode/utf8"
 	"regexp"
+	"strings"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -41,6 +42,9 @@ func validTXT(s string) bool {
 }
 
 func correctPassword(pw string, hash string) bool {
+	if strings.HasPrefix(hash, argon2Prefix) {
+		return correctArgon2id(pw, hash)
+	}
 	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)); err == nil {
 		return true
 	}